@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Email verification and password reset
+//
+// Both send the member a link carrying a token sealed with the session keys.
+// A token names its purpose, the member and when it expires, plus a
+// fingerprint of the state it changes: the email address for verification,
+// the password hash for a reset. Using the token changes that state, so it
+// only works once, and nothing about outstanding tokens needs storing.
+var TOKEN_EMAIL_VERIFY = "email-verify"
+var TOKEN_PASSWORD_RESET = "password-reset"
+
+// Set from the config in main
+var TOKEN_CODECS []securecookie.Codec
+var EMAIL_VERIFY_TTL time.Duration
+var PASSWORD_RESET_TTL time.Duration
+var BASE_URL string
+
+// Flash key for messages that are not errors.
+var NOTICE_FLASH = "notice"
+
+var errInvalidToken = errors.New("this link is invalid or has expired")
+
+type accountToken struct {
+	Username    string
+	Fingerprint []byte
+	Expires     int64
+}
+
+func tokenFingerprint(purpose string, person Person) []byte {
+	state := person.Email
+	if purpose == TOKEN_PASSWORD_RESET {
+		state = person.Password
+	}
+	sum := sha256.Sum256([]byte(purpose + "\x00" + person.Username + "\x00" + state))
+	return sum[:]
+}
+
+func newAccountToken(purpose string, person Person, ttl time.Duration) (string, error) {
+	return securecookie.EncodeMulti(purpose, accountToken{
+		Username:    person.Username,
+		Fingerprint: tokenFingerprint(purpose, person),
+		Expires:     time.Now().Add(ttl).Unix()}, TOKEN_CODECS...)
+}
+
+// checkAccountToken returns the member token was issued to, if it is still
+// good for purpose.
+func checkAccountToken(purpose string, token string) (Person, error) {
+	var claims accountToken
+	if err := securecookie.DecodeMulti(purpose, token, &claims, TOKEN_CODECS...); err != nil {
+		return Person{}, errInvalidToken
+	}
+	if time.Now().Unix() > claims.Expires {
+		return Person{}, errInvalidToken
+	}
+	person, err := personStore.Get(claims.Username)
+	if err == errNotFound {
+		return Person{}, errInvalidToken
+	} else if err != nil {
+		return Person{}, err
+	}
+	if !hmac.Equal(claims.Fingerprint, tokenFingerprint(purpose, person)) {
+		return Person{}, errInvalidToken
+	}
+	if purpose == TOKEN_EMAIL_VERIFY && person.Emailverified {
+		return Person{}, errInvalidToken
+	}
+	return person, nil
+}
+
+func accountLink(path string, token string) string {
+	return BASE_URL + path + "?t=" + url.QueryEscape(token)
+}
+
+func sendVerificationMail(person Person) error {
+	token, err := newAccountToken(TOKEN_EMAIL_VERIFY, person, EMAIL_VERIFY_TTL)
+	if err != nil {
+		return err
+	}
+	return sendTemplateMail(person.Email, "Verify your email address", "verify_email.txt", map[string]interface{}{
+		"Name": person.Name,
+		"Link": accountLink("/verify-email", token),
+		"TTL":  durationText(EMAIL_VERIFY_TTL)})
+}
+
+func sendPasswordResetMail(person Person) error {
+	token, err := newAccountToken(TOKEN_PASSWORD_RESET, person, PASSWORD_RESET_TTL)
+	if err != nil {
+		return err
+	}
+	return sendTemplateMail(person.Email, "Reset your password", "password_reset.txt", map[string]interface{}{
+		"Name":     person.Name,
+		"Username": person.Username,
+		"Link":     accountLink("/reset-password", token),
+		"TTL":      durationText(PASSWORD_RESET_TTL)})
+}
+
+// durationText spells out d for a message, like "48 hours".
+func durationText(d time.Duration) string {
+	unit, size := "minute", time.Minute
+	if d%time.Hour == 0 {
+		unit, size = "hour", time.Hour
+	} else if d%time.Minute != 0 {
+		return d.String()
+	}
+	if n := int64(d / size); n != 1 {
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	return "1 " + unit
+}
+
+// verifyEmailHandler is where the verification link lands.
+func verifyEmailHandler(res http.ResponseWriter, req *http.Request) error {
+	session, _ := STORE.Get(req, USER_SESSION)
+	person, err := checkAccountToken(TOKEN_EMAIL_VERIFY, req.URL.Query().Get("t"))
+	if err == errInvalidToken {
+		session.AddFlash("This verification link is invalid, expired or already used.")
+		session.Save(req, res)
+		http.Redirect(res, req, "/login", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := personStore.VerifyEmail(person.Username, person.Email); err != nil {
+		return err
+	}
+	session.AddFlash("Your email address is verified.", NOTICE_FLASH)
+	session.Save(req, res)
+	http.Redirect(res, req, "/login", http.StatusSeeOther)
+	return nil
+}
+
+// resendVerificationHandler sends a logged in member a fresh link.
+func resendVerificationHandler(res http.ResponseWriter, req *http.Request) error {
+	person := currentMember(req)
+	if !person.Emailverified {
+		if err := sendVerificationMail(*person); err != nil {
+			return err
+		}
+	}
+	http.Redirect(res, req, "/user-dashboard", http.StatusSeeOther)
+	return nil
+}
+
+func forgotPasswordPageHandler(res http.ResponseWriter, req *http.Request) error {
+	return renderForgotPasswordPage(res, req, "")
+}
+
+// forgotPasswordSubmitHandler mails a reset link to the member's address on
+// file. The reply is the same whether or not the username exists, and the
+// mail is sent in the background so it does not take longer when it does.
+func forgotPasswordSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	go mailPasswordReset(req.FormValue("username"))
+	return renderForgotPasswordPage(res, req, "If that account exists, a link to reset its password is on its way to the email address we have for it.")
+}
+
+// mailPasswordReset sends username a reset link, if the member exists and
+// has an email address. Nobody waits on it, so failures are only logged.
+func mailPasswordReset(username string) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Print("Panic sending password reset mail: ", recovered)
+		}
+	}()
+	person, err := personStore.Get(username)
+	if err == errNotFound || (err == nil && person.Email == "") {
+		return
+	} else if err != nil {
+		log.Print("Error: ", err)
+		return
+	}
+	if err := sendPasswordResetMail(person); err != nil {
+		log.Print("Error sending password reset mail: ", err)
+	}
+}
+
+func renderForgotPasswordPage(res http.ResponseWriter, req *http.Request, notice string) error {
+	return renderTemplate(res, req, http.StatusOK, "forgot_password.html", map[string]interface{}{"notice": notice})
+}
+
+func resetPasswordPageHandler(res http.ResponseWriter, req *http.Request) error {
+	// keep the token out of Referer headers
+	res.Header().Set("Referrer-Policy", "no-referrer")
+	token := req.URL.Query().Get("t")
+	if _, err := checkAccountToken(TOKEN_PASSWORD_RESET, token); err == errInvalidToken {
+		token = ""
+	} else if err != nil {
+		return err
+	}
+	return renderResetPasswordPage(res, req, token, "")
+}
+
+func resetPasswordSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	token := req.FormValue("t")
+	person, err := checkAccountToken(TOKEN_PASSWORD_RESET, token)
+	if err == errInvalidToken {
+		return renderResetPasswordPage(res, req, "", "")
+	} else if err != nil {
+		return err
+	}
+	password := req.FormValue("password")
+	if problem := checkNewPassword(password, req.FormValue("confirm"), person.Username, person.Email); problem != "" {
+		return renderResetPasswordPage(res, req, token, problem)
+	}
+	if err := changeMemberPassword(person.Username, password); err != nil {
+		return err
+	}
+	// the link reached them, so the address is theirs
+	if !person.Emailverified {
+		if err := personStore.VerifyEmail(person.Username, person.Email); err != nil {
+			log.Print("Error: ", err)
+		}
+	}
+	loginSucceeded(USER_PERSON, person.Username)
+	session, _ := STORE.Get(req, USER_SESSION)
+	session.AddFlash("Your password has been changed. Please log in with the new one.", NOTICE_FLASH)
+	session.Save(req, res)
+	http.Redirect(res, req, "/login", http.StatusSeeOther)
+	return nil
+}
+
+// renderResetPasswordPage shows the new password form for token, or says
+// the link is no good when token is empty.
+func renderResetPasswordPage(res http.ResponseWriter, req *http.Request, token string, message string) error {
+	status := http.StatusOK
+	if token == "" {
+		status = http.StatusBadRequest
+	}
+	return renderTemplate(res, req, status, "reset_password.html", map[string]interface{}{"token": token, "message": message})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestAccountTokens(t *testing.T) {
+	useMemoryStores(t)
+	TOKEN_CODECS = securecookie.CodecsFromPairs([]byte("0123456789abcdef0123456789abcdef"), []byte("0123456789abcdef"))
+	if err := personStore.Insert(&Person{Username: "ann", Email: "ann@example.com", Password: "hash-1"}); err != nil {
+		t.Fatal(err)
+	}
+	ann, err := personStore.Get("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(purpose string, person Person, ttl time.Duration) string {
+		token, err := newAccountToken(purpose, person, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	reset := token(TOKEN_PASSWORD_RESET, ann, time.Hour)
+	otherKey := securecookie.CodecsFromPairs([]byte("fedcba9876543210fedcba9876543210"))
+	foreign, err := securecookie.EncodeMulti(TOKEN_PASSWORD_RESET, accountToken{
+		Username:    "ann",
+		Fingerprint: tokenFingerprint(TOKEN_PASSWORD_RESET, ann),
+		Expires:     time.Now().Add(time.Hour).Unix()}, otherKey...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		ok      bool
+	}{
+		{"reset", TOKEN_PASSWORD_RESET, reset, true},
+		{"verify", TOKEN_EMAIL_VERIFY, token(TOKEN_EMAIL_VERIFY, ann, time.Hour), true},
+		{"other purpose", TOKEN_EMAIL_VERIFY, reset, false},
+		{"expired", TOKEN_PASSWORD_RESET, token(TOKEN_PASSWORD_RESET, ann, -time.Minute), false},
+		{"tampered", TOKEN_PASSWORD_RESET, reset[:len(reset)-2] + "xx", false},
+		{"other key", TOKEN_PASSWORD_RESET, foreign, false},
+		{"unknown member", TOKEN_PASSWORD_RESET, token(TOKEN_PASSWORD_RESET, Person{Username: "bob"}, time.Hour), false},
+		{"empty", TOKEN_PASSWORD_RESET, "", false},
+	}
+	for _, test := range tests {
+		person, err := checkAccountToken(test.purpose, test.token)
+		if test.ok && (err != nil || person.Username != "ann") {
+			t.Errorf("%s: checkAccountToken = %q, %v, want ann", test.name, person.Username, err)
+		}
+		if !test.ok && err != errInvalidToken {
+			t.Errorf("%s: checkAccountToken error = %v, want errInvalidToken", test.name, err)
+		}
+	}
+
+	// using a token changes what it was issued for, so it only works once
+	if err := personStore.UpdatePassword("ann", "hash-2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkAccountToken(TOKEN_PASSWORD_RESET, reset); err != errInvalidToken {
+		t.Errorf("reset token after a password change: error = %v, want errInvalidToken", err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testApp serves the whole app from the in-memory stores to one browser,
+// which keeps its cookies and does not follow redirects.
+type testApp struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="` + CSRF_FIELD + `" value="([^"]+)"`)
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	config := defaultConfig(ENV_DEV)
+	config.MailTransport = MAIL_TRANSPORT_MEMORY
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	applyConfig(config)
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	useMemoryStores(t)
+	if err := openMailer(config); err != nil {
+		t.Fatal(err)
+	}
+	cost := PASSWORD_BCRYPT_COST
+	PASSWORD_BCRYPT_COST = bcrypt.MinCost
+	t.Cleanup(func() { PASSWORD_BCRYPT_COST = cost })
+
+	app := &testApp{t: t, server: httptest.NewServer(appRouter())}
+	t.Cleanup(app.server.Close)
+	jar, _ := cookiejar.New(nil)
+	app.client = &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	return app
+}
+
+func (app *testApp) do(req *http.Request) (*http.Response, string) {
+	app.t.Helper()
+	res, err := app.client.Do(req)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func (app *testApp) get(path string) (*http.Response, string) {
+	app.t.Helper()
+	req, err := http.NewRequest("GET", app.server.URL+path, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return app.do(req)
+}
+
+// csrfToken reads the browser's CSRF token off a page with a form.
+func (app *testApp) csrfToken() string {
+	app.t.Helper()
+	_, body := app.get("/login")
+	match := csrfFieldPattern.FindStringSubmatch(body)
+	if match == nil {
+		app.t.Fatal("no CSRF token on the login page")
+	}
+	return match[1]
+}
+
+// post sends form with the browser's CSRF token.
+func (app *testApp) post(path string, form url.Values) (*http.Response, string) {
+	app.t.Helper()
+	form.Set(CSRF_FIELD, app.csrfToken())
+	req, err := http.NewRequest("POST", app.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return app.do(req)
+}
+
+// postFile sends form as multipart with file in field.
+func (app *testApp) postFile(path string, form url.Values, field string, filename string, file []byte) (*http.Response, string) {
+	app.t.Helper()
+	form.Set(CSRF_FIELD, app.csrfToken())
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, values := range form {
+		for _, value := range values {
+			writer.WriteField(key, value)
+		}
+	}
+	part, err := writer.CreateFormFile(field, filename)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	part.Write(file)
+	writer.Close()
+	req, err := http.NewRequest("POST", app.server.URL+path, &body)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return app.do(req)
+}
+
+// registerAdmin registers the first admin, a super admin, and logs in.
+func (app *testApp) registerAdmin(username string) {
+	app.t.Helper()
+	password := "Tq9-zebra-lamp-1"
+	res, body := app.post("/admin-registration", url.Values{"name": {"Admin"}, "username": {username},
+		"password": {password}, "password2": {password}})
+	if res.StatusCode != http.StatusSeeOther {
+		app.t.Fatalf("admin registration: %d %s", res.StatusCode, body)
+	}
+	res, _ = app.post("/admin-login", url.Values{"username": {username}, "password": {password}})
+	if location := res.Header.Get("Location"); location != "/admin-dashboard" {
+		app.t.Fatalf("admin login went to %q", location)
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var data bytes.Buffer
+	if err := png.Encode(&data, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return data.Bytes()
+}
+
+func memberForm(username string, password string) url.Values {
+	return url.Values{
+		"name": {"Ann Smith"}, "gender": {"female"}, "dob": {"1990-04-01"}, "documenttype": {DOCUMENT_PASSPORT},
+		"passport": {"AB1234567"}, "nationality": {"GB"}, "address1": {"1 High Street"}, "country": {"GB"},
+		"mobile": {"07700 900123"}, "email": {username + "@example.com"}, "username": {username},
+		"password": {password}, "password2": {password}}
+}
+
+func TestMemberRegistrationAndLogin(t *testing.T) {
+	app := newTestApp(t)
+	password := "Kp4-violet-desk"
+
+	res, body := app.postFile("/registration", memberForm("ann", password), "document", "passport.png", testPNG(t))
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+		t.Fatalf("registration: %d %s", res.StatusCode, body)
+	}
+	ann, err := personStore.Get("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ann.Mobile != "+447700900123" || ann.Kycstatus != KYC_NEW || ann.Password == password {
+		t.Errorf("registered member = %+v", ann)
+	}
+	documents, err := documentStore.ListByMember("ann")
+	if err != nil || len(documents) != 1 {
+		t.Errorf("documents = %v, %v, want the passport", documents, err)
+	}
+	if sent := mailer.(*memoryMailer).sent; len(sent) != 1 || sent[0].To != "ann@example.com" {
+		t.Errorf("mail sent = %+v, want a verification mail to ann", sent)
+	}
+
+	res, _ = app.postFile("/registration", memberForm("ann", password), "document", "passport.png", testPNG(t))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("registering ann twice: status %d, want 400", res.StatusCode)
+	}
+
+	res, _ = app.post("/login", url.Values{"username": {"ann"}, "password": {password}})
+	if location := res.Header.Get("Location"); location != "/user-dashboard" {
+		t.Fatalf("login went to %q", location)
+	}
+	res, body = app.get("/user-dashboard")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, "Ann Smith") {
+		t.Errorf("dashboard: %d", res.StatusCode)
+	}
+
+	res, _ = app.post("/login", url.Values{"username": {"ann"}, "password": {"wrong-password"}})
+	if location := res.Header.Get("Location"); location != "/login" {
+		t.Errorf("login with a wrong password went to %q", location)
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	app := newTestApp(t)
+	tests := []struct {
+		path     string
+		location string
+	}{
+		{"/user-dashboard", "/login?next=%2Fuser-dashboard"},
+		{"/profile", "/login?next=%2Fprofile"},
+		{"/admin-dashboard", "/admin-login?next=%2Fadmin-dashboard"},
+		{"/audit-log", "/admin-login?next=%2Faudit-log"},
+	}
+	for _, test := range tests {
+		res, _ := app.get(test.path)
+		if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != test.location {
+			t.Errorf("GET %s: %d to %q, want 303 to %q", test.path, res.StatusCode, res.Header.Get("Location"), test.location)
+		}
+	}
+}
+
+func TestAdminRemovesMember(t *testing.T) {
+	app := newTestApp(t)
+	app.registerAdmin("root")
+	if err := personStore.Insert(&Person{Username: "ann", Email: "ann@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	ann, err := personStore.Get("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, body := app.post("/remove-user", url.Values{"id": {ann.ID.Hex()}})
+	if res.StatusCode != http.StatusOK || body != "done" {
+		t.Fatalf("remove-user: %d %q", res.StatusCode, body)
+	}
+	if _, err := personStore.Get("ann"); err != errNotFound {
+		t.Errorf("ann after removal: %v, want errNotFound", err)
+	}
+	entries, err := auditStore.List(AuditFilter{Action: AUDIT_MEMBER_DELETE}, 10)
+	if err != nil || len(entries) != 1 || entries[0].Admin != "root" || entries[0].Target != "ann" {
+		t.Errorf("audit entries = %+v, %v, want root removing ann", entries, err)
+	}
+
+	res, _ = app.post("/remove-user", url.Values{"id": {ann.ID.Hex()}})
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("removing ann again: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestAdminTotpOff(t *testing.T) {
+	app := newTestApp(t)
+	app.registerAdmin("root")
+	if res, _ := app.get("/totp-setup"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /totp-setup with admin_totp off: status %d, want 404", res.StatusCode)
+	}
+	res, body := app.get("/admin-dashboard")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET /admin-dashboard: status %d", res.StatusCode)
+	}
+	if strings.Contains(body, "/totp-setup") {
+		t.Error("the dashboard links to /totp-setup with admin_totp off")
+	}
+}
+
+func TestUnknownPaths(t *testing.T) {
+	app := newTestApp(t)
+	if res, _ := app.get("/no-such-page"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /no-such-page: status %d, want 404", res.StatusCode)
+	}
+	if res, _ := app.post("/no-such-page", url.Values{}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /no-such-page: status %d, want 404", res.StatusCode)
+	}
+	res, _ := app.post("/", url.Values{})
+	if res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != "GET" {
+		t.Errorf("POST /: status %d, Allow %q, want 405 allowing GET", res.StatusCode, res.Header.Get("Allow"))
+	}
+	res, _ = app.post("/admin-dashboard", url.Values{})
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin-dashboard: status %d, want 405", res.StatusCode)
+	}
+}
+
+func TestFirstAdminRegistration(t *testing.T) {
+	app := newTestApp(t)
+	if res, body := app.get("/admin-registration"); res.StatusCode != http.StatusOK || !strings.Contains(body, "password2") {
+		t.Fatalf("registration page before any admin: %d", res.StatusCode)
+	}
+	app.registerAdmin("root")
+	if root, err := adminStore.Get("root"); err != nil || root.Role != ROLE_SUPER_ADMIN {
+		t.Errorf("first admin = %+v, %v, want a super admin", root, err)
+	}
+
+	// another browser, not logged in
+	jar, _ := cookiejar.New(nil)
+	other := &testApp{t: t, server: app.server, client: &http.Client{Jar: jar, CheckRedirect: app.client.CheckRedirect}}
+	password := "Tq9-zebra-lamp-2"
+	res, _ := other.post("/admin-registration", url.Values{"name": {"Bob"}, "username": {"bob"},
+		"password": {password}, "password2": {password}, "role": {string(ROLE_SUPER_ADMIN)}})
+	if location := res.Header.Get("Location"); location != "/admin-login" {
+		t.Errorf("anonymous registration once an admin exists went to %q, want /admin-login", location)
+	}
+	if _, err := adminStore.Get("bob"); err != errNotFound {
+		t.Errorf("bob after anonymous registration: %v, want errNotFound", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !embed
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// ASSETS holds view/ and static/. This build reads them from the working
+// directory; building with -tags embed compiles them into the binary
+// instead (see assets_embed.go).
+var ASSETS fs.FS = os.DirFS(".")
+
+var ASSETS_EMBEDDED = false
@@ -0,0 +1,16 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed view static
+var embeddedAssets embed.FS
+
+// ASSETS holds view/ and static/, compiled into this build.
+var ASSETS fs.FS = embeddedAssets
+
+var ASSETS_EMBEDDED = true
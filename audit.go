@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Audit trail
+//
+// Every admin action, and every change members make to their own records,
+// appends an entry to the audit collection. Entries are never updated or
+// removed; each one carries the hash of the entry before it, so editing or
+// deleting an entry breaks the chain from that point on.
+var auditStore AuditStore
+
+var DB_COLLECTION_AUDIT string
+
+var AUDIT_KYC_REVIEW = "kyc_review"
+var AUDIT_MEMBER_EDIT = "member_edit"
+var AUDIT_MEMBER_DELETE = "member_delete"
+var AUDIT_DOCUMENT_REVIEW = "document_review"
+var AUDIT_ADMIN_REGISTER = "admin_register"
+var AUDIT_ADMIN_ROLE = "admin_role"
+var AUDIT_ADMIN_REMOVE = "admin_remove"
+var AUDIT_SESSION_REVOKE = "session_revoke"
+var AUDIT_LOGIN_LOCKOUT = "login_lockout"
+var AUDIT_LOGIN_UNLOCK = "login_unlock"
+var AUDIT_TOTP_ENABLE = "totp_enable"
+var AUDIT_TOTP_RECOVERY = "totp_recovery"
+var AUDIT_TOTP_RESET = "totp_reset"
+var AUDIT_PROFILE_UPDATE = "profile_update"
+var AUDIT_PASSWORD_CHANGE = "password_change"
+var AUDIT_DOCUMENT_UPLOAD = "document_upload"
+var AUDIT_MRZ_UPDATE = "mrz_update"
+
+var AUDIT_ACTIONS = []string{AUDIT_KYC_REVIEW, AUDIT_MEMBER_EDIT, AUDIT_MEMBER_DELETE, AUDIT_DOCUMENT_REVIEW,
+	AUDIT_ADMIN_REGISTER, AUDIT_ADMIN_ROLE, AUDIT_ADMIN_REMOVE, AUDIT_SESSION_REVOKE,
+	AUDIT_LOGIN_LOCKOUT, AUDIT_LOGIN_UNLOCK, AUDIT_TOTP_ENABLE, AUDIT_TOTP_RECOVERY, AUDIT_TOTP_RESET,
+	AUDIT_PROFILE_UPDATE, AUDIT_PASSWORD_CHANGE, AUDIT_DOCUMENT_UPLOAD, AUDIT_MRZ_UPDATE}
+
+// Fields left out of diffs, and fields whose values are never written out.
+var AUDIT_SKIP_FIELDS = map[string]bool{"_id": true, "document": true, "updated": true}
+var AUDIT_REDACTED_FIELDS = map[string]bool{"password": true, "totpsecret": true, "recoverycodes": true}
+
+var AUDIT_PAGE_SIZE = 200
+
+// How often Append retries when another writer took the next sequence number.
+var AUDIT_APPEND_RETRIES = 5
+
+type AuditEntry struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	Seq          int64         `bson:"seq" json:"seq"`
+	Time         time.Time     `bson:"time" json:"time"`
+	Admin        string        `bson:"admin" json:"admin"`
+	Action       string        `bson:"action" json:"action"`
+	Target       string        `bson:"target" json:"target"`
+	Ref          string        `bson:"ref,omitempty" json:"ref,omitempty"`
+	Changes      []AuditChange `bson:"changes" json:"changes"`
+	IP           string        `bson:"ip" json:"ip"`
+	Forwardedfor string        `bson:"forwardedfor,omitempty" json:"forwardedfor,omitempty"`
+	Prevhash     string        `bson:"prevhash" json:"prevhash"`
+	Hash         string        `bson:"hash" json:"hash"`
+}
+
+type AuditChange struct {
+	Field  string `bson:"field" json:"field"`
+	Before string `bson:"before" json:"before"`
+	After  string `bson:"after" json:"after"`
+}
+
+// seal places entry after prev in the chain and computes its hash. Times are
+// kept to the millisecond, which is all Mongo stores.
+func (entry *AuditEntry) seal(prev AuditEntry) {
+	if entry.ID == "" {
+		entry.ID = bson.NewObjectId()
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC().Truncate(time.Millisecond)
+	entry.Seq = prev.Seq + 1
+	entry.Prevhash = prev.Hash
+	entry.Hash = entry.computeHash()
+}
+
+// computeHash hashes everything but the ID and the hash itself.
+func (entry AuditEntry) computeHash() string {
+	changes := entry.Changes
+	if len(changes) == 0 {
+		changes = nil
+	}
+	data, _ := json.Marshal(struct {
+		Seq          int64
+		Time         string
+		Admin        string
+		Action       string
+		Target       string
+		Ref          string
+		Changes      []AuditChange
+		IP           string
+		Forwardedfor string
+		Prevhash     string
+	}{entry.Seq, entry.Time.UTC().Format(time.RFC3339Nano), entry.Admin, entry.Action, entry.Target, entry.Ref,
+		changes, entry.IP, entry.Forwardedfor, entry.Prevhash})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditChainError reports the first entry that does not fit the chain.
+type AuditChainError struct {
+	Seq    int64
+	Reason string
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("audit: entry %d: %s", e.Seq, e.Reason)
+}
+
+// verifyAuditChain walks the whole log in order and returns the number of
+// entries and the last one, which can be recorded elsewhere to also detect
+// entries being cut off the end.
+func verifyAuditChain() (count int, head AuditEntry, err error) {
+	err = auditStore.Each(func(entry AuditEntry) error {
+		switch {
+		case entry.Seq != head.Seq+1:
+			return &AuditChainError{entry.Seq, fmt.Sprintf("expected sequence %d", head.Seq+1)}
+		case entry.Prevhash != head.Hash:
+			return &AuditChainError{entry.Seq, "previous hash does not match"}
+		case entry.computeHash() != entry.Hash:
+			return &AuditChainError{entry.Seq, "hash does not match contents"}
+		}
+		head = entry
+		count++
+		return nil
+	})
+	return
+}
+
+// AuditFilter selects entries; empty fields match anything.
+type AuditFilter struct {
+	Admin  string
+	Action string
+	Target string
+}
+
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Admin != "" {
+		query["admin"] = f.Admin
+	}
+	if f.Action != "" {
+		query["action"] = f.Action
+	}
+	if f.Target != "" {
+		query["target"] = f.Target
+	}
+	return query
+}
+
+// AuditStore is append-only on purpose: there is no way to change or remove
+// an entry through it.
+type AuditStore interface {
+	Append(entry *AuditEntry) error
+	List(filter AuditFilter, limit int) ([]AuditEntry, error)
+	Each(fn func(entry AuditEntry) error) error
+}
+
+// Mongo implementation
+
+type mgoAuditStore struct {
+	mgoCollection
+	mu sync.Mutex
+}
+
+func newMgoAuditStore(session *mgo.Session) *mgoAuditStore {
+	return &mgoAuditStore{mgoCollection: mgoCollection{session, DB_COLLECTION_AUDIT}}
+}
+
+// Append takes the next sequence number. The unique index on seq stops two
+// app instances from both extending the chain from the same entry; the
+// loser retries on top of the winner.
+func (s *mgoAuditStore) Append(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.with(func(c *mgo.Collection) error {
+		for attempt := 0; ; attempt++ {
+			var prev AuditEntry
+			err := c.Find(nil).Sort("-seq").One(&prev)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			entry.seal(prev)
+			err = c.Insert(entry)
+			if !mgo.IsDup(err) || attempt == AUDIT_APPEND_RETRIES {
+				return err
+			}
+		}
+	})
+}
+
+func (s *mgoAuditStore) List(filter AuditFilter, limit int) (entries []AuditEntry, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(filter.query()).Sort("-seq").Limit(limit).All(&entries)
+	})
+	return
+}
+
+func (s *mgoAuditStore) Each(fn func(entry AuditEntry) error) error {
+	return s.with(func(c *mgo.Collection) error {
+		iter := c.Find(nil).Sort("seq").Iter()
+		var entry AuditEntry
+		for iter.Next(&entry) {
+			if err := fn(entry); err != nil {
+				iter.Close()
+				return err
+			}
+			entry = AuditEntry{}
+		}
+		return iter.Close()
+	})
+}
+
+// In-memory implementation
+
+type memoryAuditStore struct {
+	docs *memoryCollection
+	mu   sync.Mutex
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{docs: newMemoryCollection()}
+}
+
+func (s *memoryAuditStore) Append(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []AuditEntry
+	if err := s.docs.findAll(bson.M{}, nil, &entries); err != nil {
+		return err
+	}
+	var prev AuditEntry
+	if len(entries) > 0 {
+		prev = entries[len(entries)-1]
+	}
+	entry.seal(prev)
+	return s.docs.insert(entry)
+}
+
+func (s *memoryAuditStore) List(filter AuditFilter, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if err := s.docs.findAll(filter.query(), nil, &entries); err != nil {
+		return nil, err
+	}
+	newest := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(newest) < limit; i-- {
+		newest = append(newest, entries[i])
+	}
+	return newest, nil
+}
+
+func (s *memoryAuditStore) Each(fn func(entry AuditEntry) error) error {
+	var entries []AuditEntry
+	if err := s.docs.findAll(bson.M{}, nil, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordAudit appends an entry for an admin action on target. before and
+// after are the record as it was and as it will be; either may be nil.
+// Handlers record the entry before making the change and return the error
+// if it fails, so no change goes unaudited. A change that fails after its
+// entry was written leaves an entry for an attempt, which is the lesser
+// harm.
+func recordAudit(req *http.Request, action string, target string, ref string, before interface{}, after interface{}) error {
+	entry := AuditEntry{
+		Admin:        auditAdmin(req),
+		Action:       action,
+		Target:       target,
+		Ref:          ref,
+		Changes:      diffFields(before, after),
+		IP:           clientIP(req),
+		Forwardedfor: req.Header.Get("X-Forwarded-For")}
+	return auditStore.Append(&entry)
+}
+
+// auditAdmin names the admin behind req, or the member changing their own
+// records as "member:<username>". Only the first admin registers without
+// being logged in.
+func auditAdmin(req *http.Request) string {
+	if admin := currentAdmin(req); admin.Username != "" {
+		return admin.Username
+	}
+	if member := currentMember(req); member != nil {
+		return "member:" + member.Username
+	}
+	return "anonymous"
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// diffFields compares two records field by field, by their bson names.
+func diffFields(before interface{}, after interface{}) []AuditChange {
+	oldFields, newFields := auditFields(before), auditFields(after)
+	names := []string{}
+	for name := range oldFields {
+		names = append(names, name)
+	}
+	for name := range newFields {
+		if _, ok := oldFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []AuditChange{}
+	for _, name := range names {
+		if oldFields[name] == newFields[name] {
+			continue
+		}
+		change := AuditChange{name, oldFields[name], newFields[name]}
+		if AUDIT_REDACTED_FIELDS[name] {
+			change.Before, change.After = redact(change.Before), redact(change.After)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func auditFields(record interface{}) map[string]string {
+	fields := map[string]string{}
+	if record == nil {
+		return fields
+	}
+	doc, err := toDocument(record)
+	if err != nil {
+		return fields
+	}
+	for name, value := range doc {
+		if AUDIT_SKIP_FIELDS[name] {
+			continue
+		}
+		switch value := value.(type) {
+		case time.Time:
+			fields[name] = value.UTC().Format(time.RFC3339)
+		case bson.ObjectId:
+			fields[name] = value.Hex()
+		default:
+			fields[name] = fmt.Sprint(value)
+		}
+	}
+	return fields
+}
+
+func auditLogHandler(res http.ResponseWriter, req *http.Request) error {
+	query := req.URL.Query()
+	filter := AuditFilter{Admin: query.Get("admin"), Action: query.Get("action"), Target: query.Get("target")}
+	entries, err := auditStore.List(filter, AUDIT_PAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"entries": entries,
+		"filter":  filter,
+		"actions": AUDIT_ACTIONS}
+	if verify, _ := strconv.ParseBool(query.Get("verify")); verify {
+		count, head, err := verifyAuditChain()
+		data["verified"] = true
+		data["verifyCount"] = count
+		data["verifyHead"] = head
+		data["verifyError"] = err
+	}
+
+	return renderTemplate(res, req, http.StatusOK, "audit_log.html", data)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// auditTestLog fills a fresh audit store with entries and returns its
+// documents, for tests to tamper with.
+func auditTestLog(t *testing.T, entries int) *memoryCollection {
+	t.Helper()
+	useMemoryStores(t)
+	req := httptest.NewRequest("POST", "/", nil)
+	for i := 0; i < entries; i++ {
+		before := Person{Username: "ann", Kycstatus: KYC_NEW}
+		after := Person{Username: "ann", Kycstatus: KYC_APPROVED}
+		if err := recordAudit(req, AUDIT_KYC_REVIEW, "ann", "", before, after); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return auditStore.(*memoryAuditStore).docs
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(docs []bson.M) []bson.M
+		seq    int64
+	}{
+		{"untouched", func(docs []bson.M) []bson.M { return docs }, 0},
+		{"edited", func(docs []bson.M) []bson.M { docs[1]["target"] = "bob"; return docs }, 2},
+		{"rehashed", func(docs []bson.M) []bson.M {
+			docs[1]["target"] = "bob"
+			var entry AuditEntry
+			bson.Unmarshal(mustMarshal(t, docs[1]), &entry)
+			docs[1]["hash"] = entry.computeHash()
+			return docs
+		}, 3},
+		{"removed", func(docs []bson.M) []bson.M { return append(docs[:1], docs[2:]...) }, 3},
+		{"reordered", func(docs []bson.M) []bson.M { docs[1], docs[2] = docs[2], docs[1]; return docs }, 3},
+	}
+	for _, test := range tests {
+		docs := auditTestLog(t, 3)
+		docs.docs = test.tamper(docs.docs)
+		count, head, err := verifyAuditChain()
+		if test.seq == 0 {
+			if err != nil || count != 3 || head.Seq != 3 {
+				t.Errorf("%s: verifyAuditChain = %d, %d, %v, want 3, 3, nil", test.name, count, head.Seq, err)
+			}
+			continue
+		}
+		chainErr, ok := err.(*AuditChainError)
+		if !ok || chainErr.Seq != test.seq {
+			t.Errorf("%s: verifyAuditChain error = %v, want one at entry %d", test.name, err, test.seq)
+		}
+	}
+}
+
+func TestAuditEntryChanges(t *testing.T) {
+	docs := auditTestLog(t, 1)
+	var entry AuditEntry
+	if err := docs.findOne(bson.M{}, &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := []AuditChange{{Field: "kycstatus", Before: "new", After: "approved"}}
+	if len(entry.Changes) != 1 || entry.Changes[0] != want[0] {
+		t.Errorf("changes = %+v, want %+v", entry.Changes, want)
+	}
+	if entry.Admin != "anonymous" || entry.Seq != 1 || entry.Prevhash != "" {
+		t.Errorf("entry = %+v, want the first, anonymous, entry", entry)
+	}
+}
+
+func mustMarshal(t *testing.T, doc bson.M) []byte {
+	t.Helper()
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// failingAuditStore cannot append, as when the audit collection is down.
+type failingAuditStore struct{ AuditStore }
+
+func (failingAuditStore) Append(entry *AuditEntry) error {
+	return errors.New("audit: write failed")
+}
+
+func TestAuditFailureStopsChange(t *testing.T) {
+	app := newTestApp(t)
+	app.registerAdmin("root")
+	if err := personStore.Insert(&Person{Username: "ann", Name: "Ann Smith", Kycstatus: KYC_NEW}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adminStore.Insert(&AdminPerson{Username: "bob", Role: ROLE_REVIEWER}); err != nil {
+		t.Fatal(err)
+	}
+	ann, err := personStore.Get("ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditStore = failingAuditStore{auditStore}
+
+	edit := memberForm("ann", "")
+	edit.Set("name", "Ann Jones")
+	tests := []struct {
+		path string
+		form url.Values
+	}{
+		{"/edit-user?id=" + ann.ID.Hex(), edit},
+		{"/view-user?id=" + ann.ID.Hex(), url.Values{"kyc": {string(KYC_APPROVED)}}},
+		{"/remove-user", url.Values{"id": {ann.ID.Hex()}}},
+		{"/admins", url.Values{"username": {"bob"}, "action": {"role"}, "role": {string(ROLE_AUDITOR)}}},
+		{"/admins", url.Values{"username": {"bob"}, "action": {"remove"}}},
+	}
+	for _, test := range tests {
+		if res, _ := app.post(test.path, test.form); res.StatusCode != http.StatusInternalServerError {
+			t.Errorf("POST %s %v: status %d, want 500", test.path, test.form, res.StatusCode)
+		}
+	}
+	if after, err := personStore.Get("ann"); err != nil || after.Name != "Ann Smith" || after.Kycstatus != KYC_NEW {
+		t.Errorf("ann after failed audits = %+v, %v, want unchanged", after, err)
+	}
+	if bob, err := adminStore.Get("bob"); err != nil || bob.Role != ROLE_REVIEWER {
+		t.Errorf("bob after failed audits = %+v, %v, want unchanged", bob, err)
+	}
+}
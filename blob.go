@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Document blobs
+//
+// Uploaded identity documents live in a BlobStore; the Person record only
+// keeps the reference returned by Put along with its metadata.
+var blobStore BlobStore
+
+var BLOB_STORE_GRIDFS = "gridfs"
+var BLOB_STORE_FILESYSTEM = "filesystem"
+var DB_GRIDFS_PREFIX = "documents"
+
+var errInvalidBlobID = errors.New("invalid blob id")
+
+type BlobStore interface {
+	Put(name string, contentType string, r io.Reader) (BlobInfo, error)
+	Open(id string) (Blob, error)
+	Delete(id string) error
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	ID          string
+	ContentType string
+	Size        int64
+	SHA256      string
+}
+
+// Blob is an open stored document, seekable so it can serve range requests.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+	ModTime() time.Time
+}
+
+// GridFS implementation
+
+type gridfsBlobStore struct {
+	session *mgo.Session
+}
+
+func newGridfsBlobStore(session *mgo.Session) *gridfsBlobStore {
+	return &gridfsBlobStore{session}
+}
+
+// gridfs opens the GridFS on a copy of the session, which the caller
+// closes when done with it.
+func (s *gridfsBlobStore) gridfs() (*mgo.GridFS, *mgo.Session) {
+	session := s.session.Copy()
+	return session.DB(DB_NAME).GridFS(DB_GRIDFS_PREFIX), session
+}
+
+func (s *gridfsBlobStore) Put(name string, contentType string, r io.Reader) (BlobInfo, error) {
+	gridfs, session := s.gridfs()
+	defer session.Close()
+	file, err := gridfs.Create(name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	file.SetContentType(contentType)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return BlobInfo{}, err
+	}
+	if err := file.Close(); err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{
+		ID:          file.Id().(bson.ObjectId).Hex(),
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (s *gridfsBlobStore) Open(id string) (Blob, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errInvalidBlobID
+	}
+	gridfs, session := s.gridfs()
+	file, err := gridfs.OpenId(bson.ObjectIdHex(id))
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return gridfsBlob{file, session}, nil
+}
+
+func (s *gridfsBlobStore) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errInvalidBlobID
+	}
+	gridfs, session := s.gridfs()
+	defer session.Close()
+	return gridfs.RemoveId(bson.ObjectIdHex(id))
+}
+
+// gridfsBlob holds on to its session until it is closed.
+type gridfsBlob struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (b gridfsBlob) Close() error {
+	defer b.session.Close()
+	return b.GridFile.Close()
+}
+
+func (b gridfsBlob) ModTime() time.Time {
+	return b.UploadDate()
+}
+
+// Local filesystem implementation
+
+type filesystemBlobStore struct {
+	dir string
+}
+
+func newFilesystemBlobStore(dir string) (*filesystemBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &filesystemBlobStore{dir}, nil
+}
+
+func (s *filesystemBlobStore) path(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", errInvalidBlobID
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+func (s *filesystemBlobStore) Put(name string, contentType string, r io.Reader) (BlobInfo, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return BlobInfo{}, err
+	}
+	id := hex.EncodeToString(random)
+	path, _ := s.path(id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return BlobInfo{}, err
+	}
+	return BlobInfo{
+		ID:          id,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (s *filesystemBlobStore) Open(id string) (Blob, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return filesystemBlob{file}, nil
+}
+
+func (s *filesystemBlobStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errNotFound
+	}
+	return err
+}
+
+type filesystemBlob struct {
+	*os.File
+}
+
+func (b filesystemBlob) ModTime() time.Time {
+	info, err := b.Stat()
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Command line
+//
+// `fiver_project <command> ...` runs a maintenance command against the
+// configured database instead of starting the server.
+var COMMANDS = map[string]func(args []string) error{
+	"audit":   auditCommand,
+	"admin":   adminCommand,
+	"keys":    keysCommand,
+	"migrate": migrateCommand,
+	"indexes": indexesCommand,
+}
+
+// commandFlags returns a flag set for a command with the -config flag every
+// command shares.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a TOML or YAML config file")
+	return flags, configFile
+}
+
+// openCommandStores loads the config and connects to the database.
+func openCommandStores(configFile string) error {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	applyConfig(config)
+	return openStores(config, false)
+}
+
+func auditCommand(args []string) error {
+	usage := errors.New("usage: audit verify|list [-config file] [-admin name] [-action action] [-target username] [-limit n]")
+	if len(args) == 0 {
+		return usage
+	}
+	flags, configFile := commandFlags("audit " + args[0])
+	admin := flags.String("admin", "", "only entries by this admin")
+	action := flags.String("action", "", "only entries for this action ("+strings.Join(AUDIT_ACTIONS, ", ")+")")
+	target := flags.String("target", "", "only entries about this member")
+	limit := flags.Int("limit", 50, "most recent entries to show")
+	flags.Parse(args[1:])
+
+	if args[0] != "verify" && args[0] != "list" {
+		return usage
+	}
+	if err := openCommandStores(*configFile); err != nil {
+		return err
+	}
+	defer dbConnection.Close()
+
+	if args[0] == "verify" {
+		count, head, err := verifyAuditChain()
+		if err != nil {
+			return fmt.Errorf("audit chain broken after %d good entries: %v", count, err)
+		}
+		fmt.Printf("audit chain ok: %d entries\n", count)
+		if count > 0 {
+			fmt.Printf("head: seq=%d hash=%s\n", head.Seq, head.Hash)
+		}
+		return nil
+	}
+
+	entries, err := auditStore.List(AuditFilter{*admin, *action, *target}, *limit)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tADMIN\tACTION\tTARGET\tIP\tCHANGES")
+	for _, entry := range entries {
+		changes := []string{}
+		for _, change := range entry.Changes {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", change.Field, change.Before, change.After))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Seq, entry.Time.UTC().Format(time.RFC3339),
+			entry.Admin, entry.Action, entry.Target, entry.IP, strings.Join(changes, "; "))
+	}
+	return w.Flush()
+}
+
+// adminCommand manages admins from the shell, which is how the first super
+// admin is appointed on a database created before roles existed, and how a
+// super admin who lost their authenticator and recovery codes gets back in.
+func adminCommand(args []string) error {
+	usage := errors.New("usage: admin role [-config file] <username> <role> | admin reset-totp [-config file] <username>")
+	if len(args) == 0 || (args[0] != "role" && args[0] != "reset-totp") {
+		return usage
+	}
+	flags, configFile := commandFlags("admin " + args[0])
+	flags.Parse(args[1:])
+	if (args[0] == "role" && flags.NArg() != 2) || (args[0] == "reset-totp" && flags.NArg() != 1) {
+		return usage
+	}
+	username := flags.Arg(0)
+	role := Role(flags.Arg(1))
+	if args[0] == "role" && !role.valid() {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	if err := openCommandStores(*configFile); err != nil {
+		return err
+	}
+	defer dbConnection.Close()
+
+	before, err := adminStore.Get(username)
+	if err != nil {
+		return fmt.Errorf("admin %q: %v", username, err)
+	}
+	action := AUDIT_ADMIN_ROLE
+	if args[0] == "role" {
+		err = adminStore.UpdateRole(username, role)
+	} else {
+		action = AUDIT_TOTP_RESET
+		err = resetTotp(username)
+	}
+	if err != nil {
+		return err
+	}
+	after, err := adminStore.Get(username)
+	if err != nil {
+		return err
+	}
+	entry := AuditEntry{
+		Admin:   "cli:" + os.Getenv("USER"),
+		Action:  action,
+		Target:  username,
+		Changes: diffFields(before, after)}
+	if err := auditStore.Append(&entry); err != nil {
+		return err
+	}
+	if args[0] == "role" {
+		fmt.Printf("%s is now %s\n", username, role.Label())
+	} else {
+		fmt.Printf("two-factor login reset for %s; they enrol again at their next login\n", username)
+	}
+	return nil
+}
+
+// keysCommand manages the session keyring; see keyring.go for the rotation
+// procedure.
+func keysCommand(args []string) error {
+	usage := errors.New("usage: keys list|generate|add|promote|retire [-config file] [-keyring file] [-keep n]")
+	if len(args) == 0 {
+		return usage
+	}
+	flags, configFile := commandFlags("keys " + args[0])
+	path := flags.String("keyring", os.Getenv("SESSION_KEYRING"), "path to the keyring file (default: session_keyring from the config)")
+	keep := flags.Int("keep", 1, "keys to keep when retiring, counting the primary")
+	flags.Parse(args[1:])
+
+	// the config can only name a keyring that already exists, since
+	// loading it reads the keyring too
+	if *path == "" && *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		*path = config.SessionKeyring
+	}
+	if *path == "" {
+		return errors.New("keys: no keyring file; pass -keyring or set session_keyring")
+	}
+
+	var keyring Keyring
+	var err error
+	switch args[0] {
+	case "list":
+		keyring, err = loadKeyring(*path)
+	case "generate":
+		keyring, err = keyringGenerate(*path)
+	case "add":
+		keyring, err = keyringAdd(*path)
+	case "promote":
+		keyring, err = keyringPromote(*path)
+	case "retire":
+		keyring, err = keyringRetire(*path, *keep)
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+	for i, pair := range keyring {
+		use := "verify only"
+		if i == 0 {
+			use = "primary"
+		}
+		fmt.Printf("%s\t%s\n", pair.ID, use)
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Configuration
+//
+// Values are resolved in order: profile defaults, the optional config file
+// (top-level keys, then the section named after the active profile), then
+// environment variables. The config file may be TOML ("key = value" with
+// [profile] tables) or YAML ("key: value" with indented profile blocks).
+// Unknown keys and profiles in the file are errors, so a misspelt setting
+// does not silently keep its default.
+var ENV_DEV = "dev"
+var ENV_STAGING = "staging"
+var ENV_PROD = "prod"
+var MIN_SESSION_KEY_LENGTH = 32
+
+type Config struct {
+	Env                      string
+	Port                     int
+	DBURL                    string
+	DBName                   string
+	DBCollectionPerson       string
+	DBCollectionAdminPerson  string
+	DBCollectionDocument     string
+	DBCollectionAudit        string
+	DBCollectionSession      string
+	DBCollectionLoginAttempt string
+	DBCollectionMigration    string
+	DBConnectTimeout         time.Duration
+	DBSocketTimeout          time.Duration
+	DBPoolLimit              int
+	DBDialAttempts           int
+	DBWriteConcern           string
+	DBWriteTimeout           time.Duration
+	DBReadMode               string
+	SessionKey               string
+	SessionKeyring           string
+	SessionIdleTimeout       time.Duration
+	SessionMaxAge            time.Duration
+	CookieSecure             bool
+	CookieSameSite           string
+	BlobStore                string
+	BlobDir                  string
+	MaxUploadBytes           int64
+	LoginMaxFailures         int
+	LoginIPMaxFailures       int
+	LoginBackoff             time.Duration
+	LoginLockout             time.Duration
+	AdminTotp                string
+	TotpKey                  string
+	TotpIssuer               string
+	BaseURL                  string
+	MailTransport            string
+	MailFrom                 string
+	MailDir                  string
+	SmtpAddr                 string
+	SmtpUsername             string
+	SmtpPassword             string
+	EmailVerifyTTL           time.Duration
+	PasswordResetTTL         time.Duration
+	TemplateReload           bool
+
+	// Hash and block key pairs from the keyring or session_key, set by
+	// validate.
+	SessionKeys [][]byte
+}
+
+// configKeys maps config file keys and environment variables to fields.
+var configKeys = []struct {
+	file string
+	env  string
+	set  func(c *Config, value string) error
+}{
+	{"port", "PORT", func(c *Config, v string) (err error) { c.Port, err = strconv.Atoi(v); return }},
+	{"db_url", "DB_URL", func(c *Config, v string) error { c.DBURL = v; return nil }},
+	{"db_name", "DB_NAME", func(c *Config, v string) error { c.DBName = v; return nil }},
+	{"db_collection_person", "DB_COLLECTION_PERSON", func(c *Config, v string) error { c.DBCollectionPerson = v; return nil }},
+	{"db_collection_admin_person", "DB_COLLECTION_ADMIN_PERSON", func(c *Config, v string) error { c.DBCollectionAdminPerson = v; return nil }},
+	{"db_collection_document", "DB_COLLECTION_DOCUMENT", func(c *Config, v string) error { c.DBCollectionDocument = v; return nil }},
+	{"db_collection_audit", "DB_COLLECTION_AUDIT", func(c *Config, v string) error { c.DBCollectionAudit = v; return nil }},
+	{"db_collection_session", "DB_COLLECTION_SESSION", func(c *Config, v string) error { c.DBCollectionSession = v; return nil }},
+	{"db_collection_login_attempt", "DB_COLLECTION_LOGIN_ATTEMPT", func(c *Config, v string) error { c.DBCollectionLoginAttempt = v; return nil }},
+	{"db_collection_migration", "DB_COLLECTION_MIGRATION", func(c *Config, v string) error { c.DBCollectionMigration = v; return nil }},
+	{"db_connect_timeout", "DB_CONNECT_TIMEOUT", func(c *Config, v string) (err error) { c.DBConnectTimeout, err = time.ParseDuration(v); return }},
+	{"db_socket_timeout", "DB_SOCKET_TIMEOUT", func(c *Config, v string) (err error) { c.DBSocketTimeout, err = time.ParseDuration(v); return }},
+	{"db_pool_limit", "DB_POOL_LIMIT", func(c *Config, v string) (err error) { c.DBPoolLimit, err = strconv.Atoi(v); return }},
+	{"db_dial_attempts", "DB_DIAL_ATTEMPTS", func(c *Config, v string) (err error) { c.DBDialAttempts, err = strconv.Atoi(v); return }},
+	{"db_write_concern", "DB_WRITE_CONCERN", func(c *Config, v string) error { c.DBWriteConcern = v; return nil }},
+	{"db_write_timeout", "DB_WRITE_TIMEOUT", func(c *Config, v string) (err error) { c.DBWriteTimeout, err = time.ParseDuration(v); return }},
+	{"db_read_mode", "DB_READ_MODE", func(c *Config, v string) error { c.DBReadMode = strings.ToLower(v); return nil }},
+	{"session_key", "SESSION_KEY", func(c *Config, v string) error { c.SessionKey = v; return nil }},
+	{"session_keyring", "SESSION_KEYRING", func(c *Config, v string) error { c.SessionKeyring = v; return nil }},
+	{"session_idle_timeout", "SESSION_IDLE_TIMEOUT", func(c *Config, v string) (err error) { c.SessionIdleTimeout, err = time.ParseDuration(v); return }},
+	{"session_max_age", "SESSION_MAX_AGE", func(c *Config, v string) (err error) { c.SessionMaxAge, err = time.ParseDuration(v); return }},
+	{"cookie_secure", "COOKIE_SECURE", func(c *Config, v string) (err error) { c.CookieSecure, err = strconv.ParseBool(v); return }},
+	{"cookie_samesite", "COOKIE_SAMESITE", func(c *Config, v string) error { c.CookieSameSite = strings.ToLower(v); return nil }},
+	{"blob_store", "BLOB_STORE", func(c *Config, v string) error { c.BlobStore = v; return nil }},
+	{"blob_dir", "BLOB_DIR", func(c *Config, v string) error { c.BlobDir = v; return nil }},
+	{"max_upload_bytes", "MAX_UPLOAD_BYTES", func(c *Config, v string) (err error) { c.MaxUploadBytes, err = strconv.ParseInt(v, 10, 64); return }},
+	{"login_max_failures", "LOGIN_MAX_FAILURES", func(c *Config, v string) (err error) { c.LoginMaxFailures, err = strconv.Atoi(v); return }},
+	{"login_ip_max_failures", "LOGIN_IP_MAX_FAILURES", func(c *Config, v string) (err error) { c.LoginIPMaxFailures, err = strconv.Atoi(v); return }},
+	{"login_backoff", "LOGIN_BACKOFF", func(c *Config, v string) (err error) { c.LoginBackoff, err = time.ParseDuration(v); return }},
+	{"login_lockout", "LOGIN_LOCKOUT", func(c *Config, v string) (err error) { c.LoginLockout, err = time.ParseDuration(v); return }},
+	{"admin_totp", "ADMIN_TOTP", func(c *Config, v string) error { c.AdminTotp = strings.ToLower(v); return nil }},
+	{"totp_key", "TOTP_KEY", func(c *Config, v string) error { c.TotpKey = v; return nil }},
+	{"totp_issuer", "TOTP_ISSUER", func(c *Config, v string) error { c.TotpIssuer = v; return nil }},
+	{"base_url", "BASE_URL", func(c *Config, v string) error { c.BaseURL = strings.TrimRight(v, "/"); return nil }},
+	{"mail_transport", "MAIL_TRANSPORT", func(c *Config, v string) error { c.MailTransport = strings.ToLower(v); return nil }},
+	{"mail_from", "MAIL_FROM", func(c *Config, v string) error { c.MailFrom = v; return nil }},
+	{"mail_dir", "MAIL_DIR", func(c *Config, v string) error { c.MailDir = v; return nil }},
+	{"smtp_addr", "SMTP_ADDR", func(c *Config, v string) error { c.SmtpAddr = v; return nil }},
+	{"smtp_username", "SMTP_USERNAME", func(c *Config, v string) error { c.SmtpUsername = v; return nil }},
+	{"smtp_password", "SMTP_PASSWORD", func(c *Config, v string) error { c.SmtpPassword = v; return nil }},
+	{"email_verify_ttl", "EMAIL_VERIFY_TTL", func(c *Config, v string) (err error) { c.EmailVerifyTTL, err = time.ParseDuration(v); return }},
+	{"password_reset_ttl", "PASSWORD_RESET_TTL", func(c *Config, v string) (err error) { c.PasswordResetTTL, err = time.ParseDuration(v); return }},
+	{"template_reload", "TEMPLATE_RELOAD", func(c *Config, v string) (err error) { c.TemplateReload, err = strconv.ParseBool(v); return }},
+}
+
+func defaultConfig(env string) Config {
+	config := Config{
+		Env:                      env,
+		Port:                     3000,
+		DBURL:                    "mongodb://127.0.0.1:27017/",
+		DBName:                   "fiverProject",
+		DBCollectionPerson:       "person",
+		DBCollectionAdminPerson:  "adminPerson",
+		DBCollectionDocument:     "document",
+		DBCollectionAudit:        "audit",
+		DBCollectionSession:      "session",
+		DBCollectionLoginAttempt: "loginAttempt",
+		DBCollectionMigration:    "migration",
+		DBConnectTimeout:         10 * time.Second,
+		DBSocketTimeout:          30 * time.Second,
+		DBPoolLimit:              100,
+		DBDialAttempts:           5,
+		DBWriteConcern:           "1",
+		DBWriteTimeout:           10 * time.Second,
+		DBReadMode:               "primary",
+		SessionIdleTimeout:       30 * time.Minute,
+		SessionMaxAge:            12 * time.Hour,
+		CookieSecure:             env != ENV_DEV,
+		CookieSameSite:           COOKIE_SAMESITE_LAX,
+		BlobStore:                BLOB_STORE_GRIDFS,
+		BlobDir:                  "./data/documents",
+		MaxUploadBytes:           5 << 20,
+		LoginMaxFailures:         5,
+		LoginIPMaxFailures:       20,
+		LoginBackoff:             time.Second,
+		LoginLockout:             15 * time.Minute,
+		AdminTotp:                ADMIN_TOTP_OFF,
+		TotpIssuer:               "WIS Token",
+		BaseURL:                  "http://localhost:3000",
+		MailTransport:            MAIL_TRANSPORT_FILE,
+		MailFrom:                 "WIS Token <no-reply@localhost>",
+		MailDir:                  "./data/mail",
+		EmailVerifyTTL:           48 * time.Hour,
+		PasswordResetTTL:         time.Hour,
+		TemplateReload:           env == ENV_DEV,
+	}
+	if env != ENV_DEV {
+		config.BaseURL = ""
+		config.MailTransport = MAIL_TRANSPORT_SMTP
+		config.MailFrom = ""
+		config.AdminTotp = ADMIN_TOTP_OPTIONAL
+	}
+	if env == ENV_PROD {
+		config.Port = 80
+	}
+	return config
+}
+
+// loadConfig builds the configuration for the profile named by APP_ENV
+// (default dev), reading path if it is not empty.
+func loadConfig(path string) (Config, error) {
+	env := os.Getenv("APP_ENV")
+	if env == "" {
+		env = ENV_DEV
+	}
+	if env != ENV_DEV && env != ENV_STAGING && env != ENV_PROD {
+		return Config{}, fmt.Errorf("config: unknown APP_ENV %q (want dev, staging or prod)", env)
+	}
+	config := defaultConfig(env)
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		sections, err := parseConfigFile(data)
+		if err != nil {
+			return Config{}, fmt.Errorf("config: %s: %v", path, err)
+		}
+		for _, section := range []string{"", env} {
+			if err := config.apply(sections[section], false); err != nil {
+				return Config{}, fmt.Errorf("config: %s: %v", path, err)
+			}
+		}
+	}
+
+	environ := map[string]string{}
+	for _, key := range configKeys {
+		if value, ok := os.LookupEnv(key.env); ok {
+			environ[key.env] = value
+		}
+	}
+	if err := config.apply(environ, true); err != nil {
+		return Config{}, fmt.Errorf("config: environment: %v", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// apply sets every field present in values, keyed by environment variable
+// name when fromEnv is true and by config file key otherwise.
+func (c *Config) apply(values map[string]string, fromEnv bool) error {
+	for _, key := range configKeys {
+		name := key.file
+		if fromEnv {
+			name = key.env
+		}
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := key.set(c, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", key.file, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("config: port %d out of range", c.Port)
+	}
+	if u, err := url.Parse(c.DBURL); err != nil || u.Scheme != "mongodb" {
+		return errors.New("config: db_url must be a mongodb:// URL")
+	}
+	if c.DBName == "" || c.DBCollectionPerson == "" || c.DBCollectionAdminPerson == "" || c.DBCollectionDocument == "" || c.DBCollectionAudit == "" ||
+		c.DBCollectionSession == "" || c.DBCollectionLoginAttempt == "" || c.DBCollectionMigration == "" {
+		return errors.New("config: db_name and collection names must not be empty")
+	}
+	if c.DBConnectTimeout <= 0 || c.DBSocketTimeout <= 0 || c.DBPoolLimit < 1 || c.DBDialAttempts < 1 || c.DBWriteTimeout < 0 {
+		return errors.New("config: db_connect_timeout, db_socket_timeout, db_pool_limit and db_dial_attempts must be positive")
+	}
+	if c.DBWriteConcern == "" {
+		return errors.New("config: db_write_concern must be a number of servers or a mode such as majority")
+	}
+	if _, ok := DB_READ_MODES[c.DBReadMode]; !ok {
+		return errors.New("config: db_read_mode must be primary, primarypreferred, secondary, secondarypreferred or nearest")
+	}
+	if c.SessionIdleTimeout <= 0 || c.SessionMaxAge <= 0 {
+		return errors.New("config: session_idle_timeout and session_max_age must be positive")
+	}
+	if c.LoginMaxFailures < 1 || c.LoginIPMaxFailures < 1 || c.LoginBackoff <= 0 || c.LoginLockout <= 0 {
+		return errors.New("config: login_max_failures, login_ip_max_failures, login_backoff and login_lockout must be positive")
+	}
+	if c.AdminTotp != ADMIN_TOTP_OFF && c.AdminTotp != ADMIN_TOTP_OPTIONAL && c.AdminTotp != ADMIN_TOTP_REQUIRED {
+		return fmt.Errorf("config: admin_totp must be %s, %s or %s", ADMIN_TOTP_OFF, ADMIN_TOTP_OPTIONAL, ADMIN_TOTP_REQUIRED)
+	}
+	// enrolled secrets are encrypted with the key, so it cannot be made up
+	// at startup: a new one would lock out every enrolled admin
+	if c.AdminTotp != ADMIN_TOTP_OFF && c.TotpKey == "" {
+		return fmt.Errorf("config: totp_key must be set when admin_totp is %s", c.AdminTotp)
+	}
+	if c.TotpKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.TotpKey); err != nil || len(key) != 32 {
+			return errors.New("config: totp_key must be 32 bytes, base64 encoded")
+		}
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("config: base_url must be the site's http:// or https:// address, used in links sent by mail")
+	}
+	switch c.MailTransport {
+	case MAIL_TRANSPORT_SMTP:
+		if c.SmtpAddr == "" {
+			return errors.New("config: smtp_addr must be set for the smtp mail transport")
+		}
+	case MAIL_TRANSPORT_FILE:
+		if c.MailDir == "" {
+			return errors.New("config: mail_dir must be set for the file mail transport")
+		}
+	case MAIL_TRANSPORT_MEMORY:
+	default:
+		return fmt.Errorf("config: mail_transport must be %s, %s or %s", MAIL_TRANSPORT_SMTP, MAIL_TRANSPORT_FILE, MAIL_TRANSPORT_MEMORY)
+	}
+	if c.MailFrom == "" {
+		return errors.New("config: mail_from must be set")
+	}
+	if c.EmailVerifyTTL <= 0 || c.PasswordResetTTL <= 0 {
+		return errors.New("config: email_verify_ttl and password_reset_ttl must be positive")
+	}
+	if c.CookieSameSite != COOKIE_SAMESITE_LAX && c.CookieSameSite != COOKIE_SAMESITE_STRICT {
+		return fmt.Errorf("config: cookie_samesite must be %s or %s", COOKIE_SAMESITE_LAX, COOKIE_SAMESITE_STRICT)
+	}
+	if c.BlobStore != BLOB_STORE_GRIDFS && c.BlobStore != BLOB_STORE_FILESYSTEM {
+		return fmt.Errorf("config: blob_store must be %s or %s", BLOB_STORE_GRIDFS, BLOB_STORE_FILESYSTEM)
+	}
+	if c.BlobStore == BLOB_STORE_FILESYSTEM && c.BlobDir == "" {
+		return errors.New("config: blob_dir must be set for the filesystem blob store")
+	}
+	if c.MaxUploadBytes < 1<<10 {
+		return errors.New("config: max_upload_bytes must be at least 1024")
+	}
+	if c.SessionKeyring != "" {
+		keyring, err := loadKeyring(c.SessionKeyring)
+		if err != nil {
+			return fmt.Errorf("config: session_keyring: %v", err)
+		}
+		c.SessionKeys = keyring.pairs()
+		return nil
+	}
+	if len(c.SessionKey) < MIN_SESSION_KEY_LENGTH {
+		if c.Env == ENV_PROD {
+			return fmt.Errorf("config: session_keyring, or a session_key of at least %d bytes, must be set in prod", MIN_SESSION_KEY_LENGTH)
+		}
+		if c.SessionKey == "" {
+			log.Print("config: no session_keyring set, generating a random key; sessions will not survive a restart")
+			c.SessionKeys = Keyring{newKeyPair()}.pairs()
+			return nil
+		}
+		log.Printf("config: session_key is shorter than %d bytes", MIN_SESSION_KEY_LENGTH)
+	}
+	// a lone session_key only signs cookies
+	c.SessionKeys = [][]byte{[]byte(c.SessionKey), nil}
+	return nil
+}
+
+// String renders the configuration with secrets redacted, for logging.
+func (c Config) String() string {
+	return fmt.Sprintf("env=%s port=%d db_url=%s db_name=%s db_collection_person=%s db_collection_admin_person=%s db_collection_document=%s db_collection_audit=%s db_collection_session=%s db_collection_login_attempt=%s db_collection_migration=%s db_connect_timeout=%s db_socket_timeout=%s db_pool_limit=%d db_dial_attempts=%d db_write_concern=%s db_write_timeout=%s db_read_mode=%s session_key=%s session_keyring=%s session_idle_timeout=%s session_max_age=%s cookie_secure=%t cookie_samesite=%s blob_store=%s blob_dir=%s max_upload_bytes=%d login_max_failures=%d login_ip_max_failures=%d login_backoff=%s login_lockout=%s admin_totp=%s totp_key=%s totp_issuer=%s base_url=%s mail_transport=%s mail_from=%s mail_dir=%s smtp_addr=%s smtp_username=%s smtp_password=%s email_verify_ttl=%s password_reset_ttl=%s template_reload=%t",
+		c.Env, c.Port, redactURL(c.DBURL), c.DBName, c.DBCollectionPerson, c.DBCollectionAdminPerson, c.DBCollectionDocument, c.DBCollectionAudit, c.DBCollectionSession, c.DBCollectionLoginAttempt, c.DBCollectionMigration,
+		c.DBConnectTimeout, c.DBSocketTimeout, c.DBPoolLimit, c.DBDialAttempts, c.DBWriteConcern, c.DBWriteTimeout, c.DBReadMode, redact(c.SessionKey), c.SessionKeyring, c.SessionIdleTimeout, c.SessionMaxAge, c.CookieSecure, c.CookieSameSite,
+		c.BlobStore, c.BlobDir, c.MaxUploadBytes, c.LoginMaxFailures, c.LoginIPMaxFailures, c.LoginBackoff, c.LoginLockout,
+		c.AdminTotp, redact(c.TotpKey), c.TotpIssuer,
+		c.BaseURL, c.MailTransport, c.MailFrom, c.MailDir, c.SmtpAddr, c.SmtpUsername, redact(c.SmtpPassword), c.EmailVerifyTTL, c.PasswordResetTTL, c.TemplateReload)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return "(unset)"
+	}
+	return "[redacted]"
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return u.String()
+}
+
+// applyConfig copies config into the package globals used by the handlers.
+func applyConfig(config Config) {
+	PORT = config.Port
+	DB_URL = config.DBURL
+	DB_NAME = config.DBName
+	DB_COLLECTION_PERSON = config.DBCollectionPerson
+	DB_COLLECTION_ADMIN_PERSON = config.DBCollectionAdminPerson
+	DB_COLLECTION_DOCUMENT = config.DBCollectionDocument
+	DB_COLLECTION_AUDIT = config.DBCollectionAudit
+	MAX_UPLOAD_BYTES = config.MaxUploadBytes
+	LOGIN_MAX_FAILURES = config.LoginMaxFailures
+	LOGIN_IP_MAX_FAILURES = config.LoginIPMaxFailures
+	LOGIN_BACKOFF = config.LoginBackoff
+	LOGIN_LOCKOUT = config.LoginLockout
+	ADMIN_TOTP = config.AdminTotp
+	TOTP_KEY, _ = base64.StdEncoding.DecodeString(config.TotpKey)
+	TOTP_ISSUER = config.TotpIssuer
+	BASE_URL = config.BaseURL
+	EMAIL_VERIFY_TTL = config.EmailVerifyTTL
+	PASSWORD_RESET_TTL = config.PasswordResetTTL
+	TEMPLATE_RELOAD = config.TemplateReload
+	DB_COLLECTION_SESSION = config.DBCollectionSession
+	DB_COLLECTION_LOGIN_ATTEMPT = config.DBCollectionLoginAttempt
+	DB_COLLECTION_MIGRATION = config.DBCollectionMigration
+	DB_CONNECT_TIMEOUT = config.DBConnectTimeout
+	DB_SOCKET_TIMEOUT = config.DBSocketTimeout
+	DB_POOL_LIMIT = config.DBPoolLimit
+	DB_DIAL_ATTEMPTS = config.DBDialAttempts
+	DB_WRITE_CONCERN = config.DBWriteConcern
+	DB_WRITE_TIMEOUT = config.DBWriteTimeout
+	DB_READ_MODE = config.DBReadMode
+	SESSION_IDLE_TIMEOUT = config.SessionIdleTimeout
+	SESSION_MAX_AGE = config.SessionMaxAge
+	SESSION_KEYS = config.SessionKeys
+	STORE = newServerStore(SESSION_KEYS...)
+	STORE.Options.MaxAge = int(config.SessionMaxAge.Seconds())
+	STORE.Options.Secure = config.CookieSecure
+	TOKEN_CODECS = securecookie.CodecsFromPairs(SESSION_KEYS...)
+	CSRF_STORE = sessions.NewCookieStore(SESSION_KEYS...)
+	CSRF_STORE.Options.HttpOnly = true
+	CSRF_STORE.Options.Secure = config.CookieSecure
+	COOKIE_SAMESITE = config.CookieSameSite
+}
+
+// parseConfigFile reads a flat TOML or YAML document into sections keyed by
+// profile name; top-level keys live in the "" section. Keys missing from
+// configKeys and sections other than the profiles are rejected.
+func parseConfigFile(data []byte) (map[string]map[string]string, error) {
+	known := map[string]bool{}
+	for _, key := range configKeys {
+		known[key.file] = true
+	}
+	sections := map[string]map[string]string{"": {}}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+
+		// TOML table or YAML mapping header
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		} else if strings.HasSuffix(line, ":") && !indented {
+			section = strings.TrimSpace(strings.TrimSuffix(line, ":"))
+		} else {
+			sep := strings.IndexAny(line, "=:")
+			if sep < 0 {
+				return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+			}
+			if !indented && line[sep] == ':' {
+				section = ""
+			}
+			key := strings.TrimSpace(line[:sep])
+			if !known[key] {
+				return nil, fmt.Errorf("line %d: unknown key %q", lineNo, key)
+			}
+			value := unquote(strings.TrimSpace(line[sep+1:]))
+			if sections[section] == nil {
+				sections[section] = map[string]string{}
+			}
+			sections[section][key] = value
+			continue
+		}
+		if section != ENV_DEV && section != ENV_STAGING && section != ENV_PROD {
+			return nil, fmt.Errorf("line %d: unknown profile %q (want dev, staging or prod)", lineNo, section)
+		}
+		if sections[section] == nil {
+			sections[section] = map[string]string{}
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// unquote strips quotes and trailing comments from a value. Quoted values
+// end at the first closing quote, so they may hold " #".
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			if unquoted, err := strconv.Unquote(`"` + value[1:end+1] + `"`); err == nil {
+				return unquoted
+			}
+			return value[1 : end+1]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
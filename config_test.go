@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var TEST_TOTP_KEY = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestParseConfigFile(t *testing.T) {
+	want := map[string]map[string]string{
+		"":        {"db_name": "fiver", "session_idle_timeout": "10m"},
+		"dev":     {"port": "3001"},
+		"staging": {"db_url": "mongodb://staging:27017/", "mail_from": "WIS <no-reply@example.com>"},
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"toml", `
+# comment
+db_name = "fiver"
+session_idle_timeout = "10m" # trailing comment
+
+[dev]
+port = 3001
+
+[staging]
+db_url = 'mongodb://staging:27017/'
+mail_from = "WIS <no-reply@example.com>"
+`},
+		{"yaml", `---
+db_name: fiver
+dev:
+  port: 3001
+staging:
+  db_url: "mongodb://staging:27017/"
+  mail_from: "WIS <no-reply@example.com>"
+session_idle_timeout: 10m
+`},
+	}
+	for _, test := range tests {
+		sections, err := parseConfigFile([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for section, values := range want {
+			for key, value := range values {
+				if got := sections[section][key]; got != value {
+					t.Errorf("%s: [%s] %s = %q, want %q", test.name, section, key, got, value)
+				}
+			}
+			if len(sections[section]) != len(values) {
+				t.Errorf("%s: [%s] = %v, want %v", test.name, section, sections[section], values)
+			}
+		}
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown key", "db_name = \"fiver\"\nsesion_max_age = \"1h\"\n", `line 2: unknown key "sesion_max_age"`},
+		{"unknown key in profile", "[prod]\nadmin_totp_key = \"x\"\n", `line 2: unknown key "admin_totp_key"`},
+		{"unknown toml profile", "[production]\nport = 80\n", `line 1: unknown profile "production"`},
+		{"unknown yaml profile", "db_name: fiver\nproduction:\n  port: 80\n", `line 2: unknown profile "production"`},
+		{"no value", "[dev]\nport\n", "line 2: expected key = value"},
+	}
+	for _, test := range tests {
+		_, err := parseConfigFile([]byte(test.data))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestConfigExampleParses(t *testing.T) {
+	data, err := ioutil.ReadFile("config.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfigFile(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := "session_idle_timeout = \"10m\"\nport = 4000\n\n[staging]\nport = 5000\nbase_url = \"https://staging.example.com\"\nsmtp_addr = \"mail:25\"\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APP_ENV", ENV_STAGING)
+	t.Setenv("TOTP_KEY", TEST_TOTP_KEY)
+	t.Setenv("PORT", "6000")
+	t.Setenv("MAIL_FROM", "WIS <no-reply@example.com>")
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 6000 {
+		t.Errorf("port = %d, want PORT over the file", config.Port)
+	}
+	if config.SessionIdleTimeout != 10*time.Minute {
+		t.Errorf("session_idle_timeout = %v, want the file's top-level 10m", config.SessionIdleTimeout)
+	}
+	if config.BaseURL != "https://staging.example.com" || config.AdminTotp != ADMIN_TOTP_OPTIONAL {
+		t.Errorf("config = %v, want the staging profile", config)
+	}
+
+	t.Setenv("PORT", "port")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "invalid port") {
+		t.Errorf("PORT=port: error = %v, want invalid port", err)
+	}
+}
+
+func TestConfigTotpKey(t *testing.T) {
+	tests := []struct {
+		adminTotp string
+		totpKey   string
+		ok        bool
+	}{
+		{ADMIN_TOTP_OFF, "", true},
+		{ADMIN_TOTP_OFF, TEST_TOTP_KEY, true},
+		{ADMIN_TOTP_OPTIONAL, "", false},
+		{ADMIN_TOTP_REQUIRED, "", false},
+		{ADMIN_TOTP_OPTIONAL, TEST_TOTP_KEY, true},
+		{ADMIN_TOTP_REQUIRED, TEST_TOTP_KEY, true},
+		{ADMIN_TOTP_REQUIRED, "c2hvcnQ=", false},
+		{ADMIN_TOTP_REQUIRED, "not base64!", false},
+		{"sometimes", TEST_TOTP_KEY, false},
+	}
+	for _, test := range tests {
+		config := defaultConfig(ENV_DEV)
+		config.AdminTotp = test.adminTotp
+		config.TotpKey = test.totpKey
+		err := config.validate()
+		if (err == nil) != test.ok {
+			t.Errorf("admin_totp %q, totp_key %q: error = %v, want ok %v", test.adminTotp, test.totpKey, err, test.ok)
+		}
+		if err == nil && config.TotpKey != test.totpKey {
+			t.Errorf("admin_totp %q: totp_key changed to %q", test.adminTotp, config.TotpKey)
+		}
+	}
+}
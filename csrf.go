@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// CSRF protection
+//
+// Every browser gets a random token in its own session. Pages put it in
+// their forms through the csrfField template function, given the page's
+// csrfToken (which scripts read from the csrf-token meta tag), and
+// csrfProtect rejects any state-changing request that does
+// not send it back.
+var CSRF_SESSION = "csrf-session"
+var CSRF_FIELD = "csrf_token"
+var CSRF_HEADER = "X-CSRF-Token"
+
+// The token is no secret worth a server-side session, so it lives in a
+// cookie of its own; set from the config.
+var CSRF_STORE *sessions.CookieStore
+
+var COOKIE_SAMESITE_LAX = "lax"
+var COOKIE_SAMESITE_STRICT = "strict"
+
+var COOKIE_SAMESITE_ATTRIBUTES = map[string]string{COOKIE_SAMESITE_LAX: "Lax", COOKIE_SAMESITE_STRICT: "Strict"}
+
+// SameSite mode for every cookie, set from the config.
+var COOKIE_SAMESITE string
+
+// csrfToken returns the token for req's browser, creating it if needed. It
+// may set a cookie, so it must run before anything is written to res.
+func csrfToken(res http.ResponseWriter, req *http.Request) string {
+	session, _ := CSRF_STORE.Get(req, CSRF_SESSION)
+	if token, ok := session.Values["token"].(string); ok && token != "" {
+		return token
+	}
+	return rotateCsrfToken(res, req)
+}
+
+// rotateCsrfToken replaces the token, which is done whenever someone logs
+// in or out so a token seen before cannot be used afterwards.
+func rotateCsrfToken(res http.ResponseWriter, req *http.Request) string {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+	session, _ := CSRF_STORE.Get(req, CSRF_SESSION)
+	session.Values["token"] = token
+	if err := session.Save(req, res); err != nil {
+		log.Print("Error saving csrf token: ", err)
+	}
+	return token
+}
+
+// csrfProtect checks the token on every request that is not GET, HEAD,
+// OPTIONS or TRACE. The token may come in a form field or, for scripts, in
+// the X-CSRF-Token header.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			next.ServeHTTP(res, req)
+			return
+		}
+		sent := req.Header.Get(CSRF_HEADER)
+		if sent == "" {
+			// multipart bodies are read here, so the upload limit has to
+			// apply before the handler gets a chance to set it
+			if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+				limitUploadBody(res, req)
+				if err := req.ParseMultipartForm(MAX_UPLOAD_BYTES); err != nil {
+					if strings.Contains(err.Error(), "request body too large") {
+						renderError(res, req, statusError(http.StatusRequestEntityTooLarge, "The upload must be smaller than "+formatBytes(MAX_UPLOAD_BYTES)+"."))
+						return
+					}
+					renderError(res, req, statusError(http.StatusBadRequest, "The form could not be read."))
+					return
+				}
+			}
+			sent = req.PostFormValue(CSRF_FIELD)
+		}
+		session, _ := CSRF_STORE.Get(req, CSRF_SESSION)
+		token, _ := session.Values["token"].(string)
+		if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			renderError(res, req, statusError(http.StatusForbidden, "Invalid or missing form token. Reload the page and try again."))
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// csrfField is the hidden form field carrying token.
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + CSRF_FIELD + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// secureCookies adds the configured SameSite attribute to every cookie the
+// app sets; the vendored sessions package cannot set it itself.
+func secureCookies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&sameSiteWriter{ResponseWriter: res}, req)
+	})
+}
+
+type sameSiteWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *sameSiteWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		cookies := w.Header()["Set-Cookie"]
+		for i, cookie := range cookies {
+			if !strings.Contains(strings.ToLower(cookie), "samesite=") {
+				cookies[i] = cookie + "; SameSite=" + COOKIE_SAMESITE_ATTRIBUTES[COOKIE_SAMESITE]
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sameSiteWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
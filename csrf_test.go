@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestCsrfProtect(t *testing.T) {
+	CSRF_STORE = sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	COOKIE_SAMESITE = COOKIE_SAMESITE_LAX
+
+	page := httptest.NewRecorder()
+	token := csrfToken(page, httptest.NewRequest("GET", "/", nil))
+	cookies := page.Result().Cookies()
+	if token == "" || len(cookies) != 1 {
+		t.Fatalf("csrfToken = %q with %d cookies, want a token in a cookie", token, len(cookies))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		cookie bool
+		header string
+		field  string
+		status int
+	}{
+		{"GET", "GET", false, "", "", http.StatusOK},
+		{"HEAD", "HEAD", false, "", "", http.StatusOK},
+		{"form field", "POST", true, "", token, http.StatusOK},
+		{"header", "POST", true, token, "", http.StatusOK},
+		{"no token", "POST", true, "", "", http.StatusForbidden},
+		{"wrong token", "POST", true, "", token + "x", http.StatusForbidden},
+		{"no cookie", "POST", false, "", token, http.StatusForbidden},
+		{"DELETE without token", "DELETE", true, "", "", http.StatusForbidden},
+	}
+	handler := csrfProtect(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	for _, test := range tests {
+		form := url.Values{}
+		if test.field != "" {
+			form.Set(CSRF_FIELD, test.field)
+		}
+		req := httptest.NewRequest(test.method, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if test.header != "" {
+			req.Header.Set(CSRF_HEADER, test.header)
+		}
+		if test.cookie {
+			req.AddCookie(cookies[0])
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, res.Code, test.status)
+		}
+	}
+}
+
+func TestSameSiteCookies(t *testing.T) {
+	COOKIE_SAMESITE = COOKIE_SAMESITE_STRICT
+	handler := secureCookies(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.SetCookie(res, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(res, &http.Cookie{Name: "b", Value: "2", SameSite: http.SameSiteLaxMode})
+		res.Write([]byte("ok"))
+	}))
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	want := []string{"a=1; SameSite=Strict", "b=2; SameSite=Lax"}
+	for i, cookie := range res.Header()["Set-Cookie"] {
+		if cookie != want[i] {
+			t.Errorf("cookie %d = %q, want %q", i, cookie, want[i])
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Database connection
+//
+// The server dials Mongo once at startup, retrying with backoff, and keeps
+// that session only as a template: each store operation runs on a Copy of
+// it that is closed when the operation ends, so requests draw their own
+// sockets from the pool (at most DB_POOL_LIMIT per server) and a broken
+// socket is never handed to the next request. A watcher pings the server
+// every DB_PING_INTERVAL; while it is unreachable pages get a 503 straight
+// away instead of each waiting out the timeouts.
+//
+// The vendored mgo cannot set a read concern, so reads are tuned with
+// DB_READ_MODE (the read preference) alone.
+var DB_CONNECT_TIMEOUT time.Duration
+var DB_SOCKET_TIMEOUT time.Duration
+var DB_POOL_LIMIT int
+var DB_DIAL_ATTEMPTS int
+var DB_WRITE_CONCERN string
+var DB_WRITE_TIMEOUT time.Duration
+var DB_READ_MODE string
+
+var DB_DIAL_BACKOFF = time.Second
+var DB_DIAL_MAX_BACKOFF = 30 * time.Second
+var DB_PING_INTERVAL = 5 * time.Second
+
+var DB_READ_MODES = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primarypreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondarypreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// Seconds a client is told to wait when the database is unreachable.
+var DB_RETRY_AFTER = 10
+
+// Parts of the errors mgo and the network give when the server cannot be
+// reached, as opposed to errors about the request itself.
+var DB_UNREACHABLE_ERRORS = []string{"no reachable servers", "Closed explicitly", "connection refused", "connection reset", "i/o timeout"}
+
+// 0 once a ping, or an operation answered with a 503, failed to reach the
+// database, and 1 again only after a ping succeeds.
+var databaseUp int32 = 1
+
+// dialDatabase connects to DB_URL, trying DB_DIAL_ATTEMPTS times and
+// doubling the wait between attempts.
+func dialDatabase() (*mgo.Session, error) {
+	info, err := mgo.ParseURL(DB_URL)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = DB_CONNECT_TIMEOUT
+	info.PoolLimit = DB_POOL_LIMIT
+	backoff := DB_DIAL_BACKOFF
+	for attempt := 1; ; attempt++ {
+		session, err := mgo.DialWithInfo(info)
+		if err == nil {
+			session.SetSocketTimeout(DB_SOCKET_TIMEOUT)
+			session.SetMode(DB_READ_MODES[DB_READ_MODE], true)
+			session.SetSafe(writeConcern())
+			return session, nil
+		}
+		if attempt >= DB_DIAL_ATTEMPTS {
+			return nil, fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+		log.Printf("Cannot reach the database (attempt %d of %d), retrying in %s: %v", attempt, DB_DIAL_ATTEMPTS, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > DB_DIAL_MAX_BACKOFF {
+			backoff = DB_DIAL_MAX_BACKOFF
+		}
+	}
+}
+
+// writeConcern reads DB_WRITE_CONCERN, a number of servers or a mode such
+// as "majority".
+func writeConcern() *mgo.Safe {
+	safe := &mgo.Safe{WTimeout: int(DB_WRITE_TIMEOUT / time.Millisecond)}
+	if w, err := strconv.Atoi(DB_WRITE_CONCERN); err == nil {
+		safe.W = w
+	} else {
+		safe.WMode = DB_WRITE_CONCERN
+	}
+	return safe
+}
+
+// watchDatabase pings the database for as long as the server runs.
+func watchDatabase(session *mgo.Session) {
+	for range time.Tick(DB_PING_INTERVAL) {
+		ping := session.Copy()
+		err := ping.Ping()
+		ping.Close()
+		if err != nil {
+			if atomic.SwapInt32(&databaseUp, 0) == 1 {
+				log.Print("Database unreachable: ", err)
+			}
+		} else if atomic.SwapInt32(&databaseUp, 1) == 0 {
+			log.Print("Database reachable again")
+		}
+	}
+}
+
+func databaseAvailable() bool {
+	return atomic.LoadInt32(&databaseUp) == 1
+}
+
+// databaseUnreachable reports whether err means the database could not be
+// reached.
+func databaseUnreachable(err error) bool {
+	if err == nil || err == errNotFound {
+		return false
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF {
+		return true
+	}
+	for _, message := range DB_UNREACHABLE_ERRORS {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireDatabase answers 503 for everything but static files while the
+// database is unreachable.
+func requireDatabase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !databaseAvailable() && !strings.HasPrefix(req.URL.Path, "/static/") {
+			renderError(res, req, statusError(http.StatusServiceUnavailable, ERROR_MESSAGES[http.StatusServiceUnavailable]))
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
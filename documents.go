@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Member documents
+//
+// Each KYC document a member submits is its own record in the document
+// collection, reviewed on its own by an admin.
+var documentStore DocumentStore
+
+var DB_COLLECTION_DOCUMENT string
+
+var DOCUMENT_PASSPORT = "passport"
+var DOCUMENT_PROOF_OF_ADDRESS = "proof_of_address"
+var DOCUMENT_SELFIE = "selfie"
+var DOCUMENT_BANK_STATEMENT = "bank_statement"
+
+// DOCUMENT_TYPES lists the document types in display order.
+var DOCUMENT_TYPES = []DocumentType{
+	{DOCUMENT_PASSPORT, "Passport / ID"},
+	{DOCUMENT_PROOF_OF_ADDRESS, "Proof of address"},
+	{DOCUMENT_SELFIE, "Selfie"},
+	{DOCUMENT_BANK_STATEMENT, "Bank statement"},
+}
+
+type DocumentStatus string
+
+var DOCUMENT_PENDING = DocumentStatus("pending")
+var DOCUMENT_APPROVED = DocumentStatus("approved")
+var DOCUMENT_REJECTED = DocumentStatus("rejected")
+
+var DATE_LAYOUT = "2006-01-02"
+
+type DocumentType struct {
+	Value string
+	Label string
+}
+
+func isDocumentType(value string) bool {
+	for _, documentType := range DOCUMENT_TYPES {
+		if documentType.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func documentTypeLabel(value string) string {
+	for _, documentType := range DOCUMENT_TYPES {
+		if documentType.Value == value {
+			return documentType.Label
+		}
+	}
+	return value
+}
+
+type MemberDocument struct {
+	ID          bson.ObjectId  `bson:"_id" json:"id"`
+	Username    string         `bson:"username" json:"username"`
+	Type        string         `bson:"type" json:"type"`
+	Filename    string         `bson:"filename" json:"filename"`
+	Blobid      string         `bson:"blobid" json:"blobid"`
+	Contenttype string         `bson:"contenttype" json:"contenttype"`
+	Size        int64          `bson:"size" json:"size"`
+	Sha256      string         `bson:"sha256" json:"sha256"`
+	Issuedate   time.Time      `bson:"issuedate,omitempty" json:"issuedate"`
+	Expirydate  time.Time      `bson:"expirydate,omitempty" json:"expirydate"`
+	Status      DocumentStatus `bson:"status" json:"status"`
+	Reason      string         `bson:"reason" json:"reason"`
+	Reviewedby  string         `bson:"reviewedby" json:"reviewedby"`
+	Reviewedat  time.Time      `bson:"reviewedat,omitempty" json:"reviewedat"`
+	Uploadedat  time.Time      `bson:"uploadedat" json:"uploadedat"`
+}
+
+func (d MemberDocument) TypeLabel() string {
+	return documentTypeLabel(d.Type)
+}
+
+func (d MemberDocument) Expired() bool {
+	return !d.Expirydate.IsZero() && d.Expirydate.Before(time.Now())
+}
+
+type DocumentStore interface {
+	Get(id string) (MemberDocument, error)
+	ListByMember(username string) ([]MemberDocument, error)
+	Insert(document *MemberDocument) error
+	UpdateReview(id string, status DocumentStatus, reason string, reviewer string, at time.Time) error
+	DeleteByMember(username string) error
+}
+
+func reviewUpdate(status DocumentStatus, reason, reviewer string, at time.Time) bson.M {
+	return bson.M{
+		"status":     status,
+		"reason":     reason,
+		"reviewedby": reviewer,
+		"reviewedat": at}
+}
+
+// Mongo implementation
+
+type mgoDocumentStore struct{ mgoCollection }
+
+func newMgoDocumentStore(session *mgo.Session) *mgoDocumentStore {
+	return &mgoDocumentStore{mgoCollection{session, DB_COLLECTION_DOCUMENT}}
+}
+
+func (s *mgoDocumentStore) Get(id string) (document MemberDocument, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return document, errNotFound
+	}
+	err = s.with(func(c *mgo.Collection) error {
+		return c.FindId(bson.ObjectIdHex(id)).One(&document)
+	})
+	return
+}
+
+func (s *mgoDocumentStore) ListByMember(username string) (documents []MemberDocument, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"username": username}).Sort("uploadedat").All(&documents)
+	})
+	return
+}
+
+func (s *mgoDocumentStore) Insert(document *MemberDocument) error {
+	if document.ID == "" {
+		document.ID = bson.NewObjectId()
+	}
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(document)
+	})
+}
+
+func (s *mgoDocumentStore) UpdateReview(id string, status DocumentStatus, reason string, reviewer string, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return errNotFound
+	}
+	return s.with(func(c *mgo.Collection) error {
+		return c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": reviewUpdate(status, reason, reviewer, at)})
+	})
+}
+
+func (s *mgoDocumentStore) DeleteByMember(username string) error {
+	return s.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"username": username})
+		return err
+	})
+}
+
+// In-memory implementation
+
+type memoryDocumentStore struct{ docs *memoryCollection }
+
+func newMemoryDocumentStore() *memoryDocumentStore {
+	return &memoryDocumentStore{newMemoryCollection()}
+}
+
+func (s *memoryDocumentStore) Get(id string) (document MemberDocument, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return document, errNotFound
+	}
+	err = s.docs.findOne(bson.M{"_id": bson.ObjectIdHex(id)}, &document)
+	return
+}
+
+func (s *memoryDocumentStore) ListByMember(username string) (documents []MemberDocument, err error) {
+	err = s.docs.findAll(bson.M{"username": username}, nil, &documents)
+	return
+}
+
+func (s *memoryDocumentStore) Insert(document *MemberDocument) error {
+	if document.ID == "" {
+		document.ID = bson.NewObjectId()
+	}
+	return s.docs.insert(document)
+}
+
+func (s *memoryDocumentStore) UpdateReview(id string, status DocumentStatus, reason string, reviewer string, at time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return errNotFound
+	}
+	return s.docs.update(bson.M{"_id": bson.ObjectIdHex(id)}, reviewUpdate(status, reason, reviewer, at))
+}
+
+func (s *memoryDocumentStore) DeleteByMember(username string) error {
+	_, err := s.docs.removeAll(bson.M{"username": username})
+	return err
+}
+
+// storeMemberDocument writes an upload to the blob store and records it.
+func storeMemberDocument(username string, documentType string, upload *UploadedDocument, issueDate, expiryDate time.Time) (*MemberDocument, error) {
+	blob, err := blobStore.Put(upload.Filename, upload.ContentType, bytes.NewReader(upload.Data))
+	if err != nil {
+		return nil, err
+	}
+	document := &MemberDocument{
+		Username:    username,
+		Type:        documentType,
+		Filename:    upload.Filename,
+		Blobid:      blob.ID,
+		Contenttype: blob.ContentType,
+		Size:        blob.Size,
+		Sha256:      blob.SHA256,
+		Issuedate:   issueDate,
+		Expirydate:  expiryDate,
+		Status:      DOCUMENT_PENDING,
+		Uploadedat:  time.Now()}
+	if err := documentStore.Insert(document); err != nil {
+		if e := blobStore.Delete(blob.ID); e != nil {
+			log.Print("Error removing orphaned document: ", e)
+		}
+		return nil, err
+	}
+	return document, nil
+}
+
+// removeMemberDocuments deletes every document record and blob of a member.
+func removeMemberDocuments(username string) error {
+	documents, err := documentStore.ListByMember(username)
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		if err := blobStore.Delete(document.Blobid); err != nil && err != errNotFound {
+			log.Print("Error removing document: ", err)
+		}
+	}
+	return documentStore.DeleteByMember(username)
+}
+
+// readDocumentDates parses the optional issue and expiry dates of an upload.
+func readDocumentDates(req *http.Request, errs FieldErrors) (issueDate, expiryDate time.Time) {
+	var err error
+	if value := req.FormValue("issuedate"); value != "" {
+		if issueDate, err = time.Parse(DATE_LAYOUT, value); err != nil {
+			errs["issuedate"] = "Use the format YYYY-MM-DD."
+		}
+	}
+	if value := req.FormValue("expirydate"); value != "" {
+		if expiryDate, err = time.Parse(DATE_LAYOUT, value); err != nil {
+			errs["expirydate"] = "Use the format YYYY-MM-DD."
+		}
+	}
+	if !issueDate.IsZero() && !expiryDate.IsZero() && !expiryDate.After(issueDate) {
+		errs["expirydate"] = "The expiry date must be after the issue date."
+	}
+	return
+}
+
+// legacyDocumentID is the ID the migrated document of username gets, so a
+// migration that stopped part way can run again without copying it twice.
+func legacyDocumentID(username string) bson.ObjectId {
+	sum := sha256.Sum256([]byte("legacy-document:" + username))
+	return bson.ObjectId(sum[:12])
+}
+
+// migrateLegacyDocuments moves the single document stored on older Person
+// records (inline bytes or a blob reference) into the document collection.
+// It can be run again: a member whose document was already copied only has
+// the old fields cleared.
+func migrateLegacyDocuments(held func() error, dryRun bool) (int, error) {
+	persons, err := personStore.List(PersonFilter{}, "username", "documentname", "document", "documentid", "documenttype", "documentsize", "documentsha256")
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, person := range persons {
+		if person.Documentid == "" && len(person.Document) == 0 {
+			continue
+		}
+		if dryRun {
+			migrated++
+			continue
+		}
+		if migrated%MIGRATION_BATCH_SIZE == 0 {
+			if err := held(); err != nil {
+				return migrated, err
+			}
+		}
+		id := legacyDocumentID(person.Username)
+		_, err := documentStore.Get(id.Hex())
+		if err != nil && err != errNotFound {
+			return migrated, err
+		}
+		if err == nil {
+			if err := personStore.ClearLegacyDocument(person.Username); err != nil {
+				return migrated, err
+			}
+			migrated++
+			continue
+		}
+		blob := BlobInfo{
+			ID:          person.Documentid,
+			ContentType: person.Documenttype,
+			Size:        person.Documentsize,
+			SHA256:      person.Documentsha256}
+		putBlob := blob.ID == ""
+		if putBlob {
+			blob, err = blobStore.Put(person.Documentname, http.DetectContentType(person.Document), bytes.NewReader(person.Document))
+			if err != nil {
+				return migrated, err
+			}
+		}
+		document := &MemberDocument{
+			ID:          id,
+			Username:    person.Username,
+			Type:        DOCUMENT_PASSPORT,
+			Filename:    person.Documentname,
+			Blobid:      blob.ID,
+			Contenttype: blob.ContentType,
+			Size:        blob.Size,
+			Sha256:      blob.SHA256,
+			Status:      DOCUMENT_PENDING,
+			Uploadedat:  time.Now()}
+		if err := documentStore.Insert(document); err != nil {
+			if putBlob {
+				if e := blobStore.Delete(blob.ID); e != nil {
+					log.Print("Error removing orphaned document: ", e)
+				}
+			}
+			return migrated, err
+		}
+		if err := personStore.ClearLegacyDocument(person.Username); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+func documentHandler(res http.ResponseWriter, req *http.Request) error {
+	document, err := documentStore.Get(req.URL.Query().Get("id"))
+	if err != nil {
+		return err
+	}
+	blob, err := blobStore.Open(document.Blobid)
+	if err == errNotFound {
+		log.Printf("Document %s has no stored file %s", document.ID.Hex(), document.Blobid)
+		return err
+	} else if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	disposition := "inline"
+	if req.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+	res.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": document.Filename}))
+	res.Header().Set("Content-Type", document.Contenttype)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(res, req, document.Filename, blob.ModTime(), blob)
+	return nil
+}
+
+func documentReviewHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	document, err := documentStore.Get(req.FormValue("id"))
+	if err != nil {
+		return err
+	}
+	status := DocumentStatus(req.FormValue("decision"))
+	reason := strings.TrimSpace(req.FormValue("reason"))
+	if status != DOCUMENT_APPROVED && status != DOCUMENT_REJECTED {
+		return statusError(http.StatusBadRequest, "")
+	}
+	if status == DOCUMENT_REJECTED && reason == "" {
+		reason = "Rejected by reviewer"
+	}
+	after := document
+	after.Status = status
+	after.Reason = reason
+	after.Reviewedby = currentAdmin(req).Username
+	after.Reviewedat = time.Now()
+	if err := recordAudit(req, AUDIT_DOCUMENT_REVIEW, document.Username, document.ID.Hex(), document, after); err != nil {
+		return err
+	}
+	if err := documentStore.UpdateReview(document.ID.Hex(), status, reason, after.Reviewedby, after.Reviewedat); err != nil {
+		return err
+	}
+	member, err := personStore.Get(document.Username)
+	if err != nil {
+		return err
+	}
+	http.Redirect(res, req, memberURL("/view-user", member), http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Error handling
+//
+// Handlers are appHandlers: instead of writing an error response they
+// return the error, and renderError turns it into a page, or JSON for
+// clients that ask for it. errNotFound becomes a 404, an httpError its own
+// status, the database being unreachable a 503 and anything else a 500,
+// which is logged with the request. recoverPanics does the same for a
+// handler that panics, so one bad request never takes the server down.
+type appHandler func(res http.ResponseWriter, req *http.Request) error
+
+func (h appHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if err := h(res, req); err != nil {
+		renderError(res, req, err)
+	}
+}
+
+// httpError is an error with the status to answer it with and a message
+// that is safe to show.
+type httpError struct {
+	Status  int
+	Message string
+}
+
+func (e *httpError) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Message
+}
+
+// statusError returns an httpError, with the standard text for status when
+// message is empty.
+func statusError(status int, message string) error {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &httpError{status, message}
+}
+
+var ERROR_MESSAGES = map[int]string{
+	http.StatusNotFound:            "We could not find the page you asked for.",
+	http.StatusInternalServerError: "Something went wrong on our side. Please try again.",
+	http.StatusServiceUnavailable:  "The service is temporarily unavailable. Please try again in a moment.",
+}
+
+// errorResponse decides the status and message for err.
+func errorResponse(err error) (int, string) {
+	if e, ok := err.(*httpError); ok {
+		return e.Status, e.Message
+	}
+	status := http.StatusInternalServerError
+	if err == errNotFound || err == errInvalidBlobID {
+		status = http.StatusNotFound
+	} else if databaseUnreachable(err) {
+		status = http.StatusServiceUnavailable
+	}
+	return status, ERROR_MESSAGES[status]
+}
+
+// renderError answers req with err.
+func renderError(res http.ResponseWriter, req *http.Request, err error) {
+	status, message := errorResponse(err)
+	if status >= http.StatusInternalServerError {
+		log.Printf("Error: %s %s: %v", req.Method, req.URL.RequestURI(), err)
+	}
+	if status == http.StatusServiceUnavailable {
+		if dbConnection != nil && databaseUnreachable(err) {
+			atomic.StoreInt32(&databaseUp, 0)
+		}
+		res.Header().Set("Retry-After", strconv.Itoa(DB_RETRY_AFTER))
+	}
+	if wantsJSON(req) {
+		res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		res.WriteHeader(status)
+		json.NewEncoder(res).Encode(map[string]interface{}{"status": status, "error": message})
+		return
+	}
+	data := map[string]interface{}{"status": status, "title": http.StatusText(status), "message": message}
+	page, err := executeTemplate(res, req, "error.html", data)
+	if err != nil {
+		log.Print("Error rendering the error page: ", err)
+		http.Error(res, message, status)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	page.WriteTo(res)
+}
+
+// wantsJSON reports whether req comes from a script rather than a browser
+// navigating, going by its Accept header or jQuery's X-Requested-With.
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json") ||
+		req.Header.Get("X-Requested-With") == "XMLHttpRequest"
+}
+
+// recoverPanics turns a panicking handler into a 500 for that request.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				log.Printf("%s", debug.Stack())
+				renderError(res, req, fmt.Errorf("panic: %v", recovered))
+			}
+		}()
+		next.ServeHTTP(res, req)
+	})
+}
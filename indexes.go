@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Indexes
+//
+// Every index the app relies on is declared in declaredIndexes and built
+// at startup, after migrations have run. The server does not start if a
+// unique index cannot be built, usually because the data already has
+// duplicates, since the stores count on them; any other index that cannot
+// be built is logged, and `indexes status` lists it with any other drift
+// between the declared and the actual indexes. Only declared indexes are
+// ever created. A declared index whose options changed is only logged at
+// startup, since rebuilding it leaves the collection without it meanwhile;
+// `indexes ensure` drops and builds it again. Extra indexes are reported,
+// never dropped.
+//
+// Tokens for email verification and password reset are signed rather than
+// stored, so sessions and login attempts are the only records that need a
+// TTL index.
+type CollectionIndexes struct {
+	Collection string
+	Indexes    []mgo.Index
+	// Partial limits indexes, by name, to the documents a filter matches.
+	// The vendored mgo cannot build those, so they are built with the
+	// createIndexes command.
+	Partial map[string]bson.M
+}
+
+// declaredIndexes reads the collection names, so it is called after the
+// config is applied.
+func declaredIndexes() []CollectionIndexes {
+	return []CollectionIndexes{
+		// members from before email was required may have none
+		{DB_COLLECTION_PERSON, []mgo.Index{
+			{Key: []string{"username"}, Unique: true},
+			{Key: []string{"email"}, Unique: true},
+			// the member lists filter by one status or the other
+			{Key: []string{"memberstatus", "kycstatus"}},
+			{Key: []string{"kycstatus"}},
+		}, map[string]bson.M{
+			"email_1": {"email": bson.M{"$gt": ""}},
+		}},
+		// admins have no email address to index
+		{DB_COLLECTION_ADMIN_PERSON, []mgo.Index{
+			{Key: []string{"username"}, Unique: true},
+		}, nil},
+		{DB_COLLECTION_DOCUMENT, []mgo.Index{
+			{Key: []string{"username", "uploadedat"}},
+		}, nil},
+		{DB_COLLECTION_AUDIT, []mgo.Index{
+			{Key: []string{"seq"}, Unique: true},
+			{Key: []string{"target", "-seq"}},
+			{Key: []string{"admin", "-seq"}},
+		}, nil},
+		{DB_COLLECTION_SESSION, []mgo.Index{
+			{Key: []string{"expires"}, ExpireAfter: time.Second},
+			{Key: []string{"name", "username"}},
+		}, nil},
+		// a lockout ends LOGIN_LOCKOUT after the failure that started it, so
+		// by then the record has nothing left to count
+		{DB_COLLECTION_LOGIN_ATTEMPT, []mgo.Index{
+			{Key: []string{"kind", "name"}, Unique: true},
+			{Key: []string{"last"}, ExpireAfter: LOGIN_LOCKOUT},
+		}, nil},
+		// migrations and their lock are only looked up by _id
+		{DB_COLLECTION_MIGRATION, nil, nil},
+	}
+}
+
+// indexName is the name Mongo gives an index on key, which is how declared
+// and actual indexes are matched up.
+func indexName(key []string) string {
+	parts := []string{}
+	for _, field := range key {
+		if strings.HasPrefix(field, "-") {
+			parts = append(parts, field[1:], "-1")
+		} else {
+			parts = append(parts, field, "1")
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// IndexDrift is one difference between the declared and actual indexes.
+// Problem is "missing", "different" or "extra".
+type IndexDrift struct {
+	Collection string
+	Name       string
+	Problem    string
+	Detail     string
+}
+
+func (d IndexDrift) String() string {
+	return fmt.Sprintf("%s.%s: %s %s", d.Collection, d.Name, d.Problem, d.Detail)
+}
+
+var errIndexConflict = errors.New("an index of the same name exists with other options")
+
+// ensureIndexes builds any declared index that is missing, and with
+// rebuild any that has changed. It fails on the first unique index it
+// cannot build and logs the others, and changed ones left as they are.
+func ensureIndexes(session *mgo.Session, rebuild bool) error {
+	for _, declared := range declaredIndexes() {
+		for _, index := range declared.Indexes {
+			err := ensureIndex(session, declared, index, rebuild)
+			if err == errIndexConflict {
+				log.Printf("Index %s on %s has other options than declared; rebuild it with `indexes ensure`", indexName(index.Key), declared.Collection)
+			} else if err != nil && index.Unique {
+				return fmt.Errorf("cannot build unique index %s on %s: %v", indexName(index.Key), declared.Collection, err)
+			} else if err != nil {
+				log.Printf("Cannot build index %s on %s: %v", indexName(index.Key), declared.Collection, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureIndex builds index. An index of the same name with other options
+// is dropped first with rebuild, and otherwise left with errIndexConflict.
+func ensureIndex(session *mgo.Session, declared CollectionIndexes, index mgo.Index, rebuild bool) error {
+	c := session.DB(DB_NAME).C(declared.Collection)
+	build := func() error {
+		partial, ok := declared.Partial[indexName(index.Key)]
+		if !ok {
+			return c.EnsureIndex(index)
+		}
+		key := bson.D{}
+		for _, field := range index.Key {
+			if strings.HasPrefix(field, "-") {
+				key = append(key, bson.DocElem{Name: field[1:], Value: -1})
+			} else {
+				key = append(key, bson.DocElem{Name: field, Value: 1})
+			}
+		}
+		return c.Database.Run(bson.D{
+			{Name: "createIndexes", Value: declared.Collection},
+			{Name: "indexes", Value: []bson.M{{
+				"key":                     key,
+				"name":                    indexName(index.Key),
+				"unique":                  index.Unique,
+				"partialFilterExpression": partial}}}}, nil)
+	}
+	err := build()
+	if !isIndexConflict(err) {
+		return err
+	}
+	if !rebuild {
+		return errIndexConflict
+	}
+	log.Printf("Rebuilding index %s on %s with its declared options", indexName(index.Key), declared.Collection)
+	if err := c.DropIndexName(indexName(index.Key)); err != nil {
+		return err
+	}
+	session.ResetIndexCache()
+	return build()
+}
+
+// isIndexConflict reports whether err is Mongo refusing an index because
+// one of the same name exists with other options.
+func isIndexConflict(err error) bool {
+	if queryErr, ok := err.(*mgo.QueryError); ok {
+		return queryErr.Code == 85 || queryErr.Code == 86
+	}
+	return err != nil && strings.Contains(err.Error(), "already exists with different options")
+}
+
+// partialFilters lists the partial filter of each index on collection, by
+// name; mgo does not report them.
+func partialFilters(session *mgo.Session, collection string) (map[string]bson.M, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Name    string `bson:"name"`
+				Partial bson.M `bson:"partialFilterExpression"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}
+	if err := session.DB(DB_NAME).Run(bson.D{{Name: "listIndexes", Value: collection}}, &result); err != nil {
+		return nil, err
+	}
+	filters := map[string]bson.M{}
+	for _, index := range result.Cursor.FirstBatch {
+		if index.Partial != nil {
+			filters[index.Name] = index.Partial
+		}
+	}
+	return filters, nil
+}
+
+// indexDrift compares the declared indexes with those in the database.
+func indexDrift(session *mgo.Session) ([]IndexDrift, error) {
+	drift := []IndexDrift{}
+	for _, declared := range declaredIndexes() {
+		actual, err := session.DB(DB_NAME).C(declared.Collection).Indexes()
+		if err != nil && !isMissingCollection(err) {
+			return nil, err
+		}
+		partial := map[string]bson.M{}
+		if len(actual) > 0 {
+			if partial, err = partialFilters(session, declared.Collection); err != nil {
+				return nil, err
+			}
+		}
+		byName := map[string]mgo.Index{}
+		for _, index := range actual {
+			byName[index.Name] = index
+		}
+		for _, index := range declared.Indexes {
+			name := indexName(index.Key)
+			want := indexOptions(index, declared.Partial[name])
+			have, ok := byName[name]
+			if !ok {
+				drift = append(drift, IndexDrift{declared.Collection, name, "missing", want})
+				continue
+			}
+			delete(byName, name)
+			if !reflect.DeepEqual(have.Key, index.Key) || indexOptions(have, partial[name]) != want {
+				drift = append(drift, IndexDrift{declared.Collection, name, "different",
+					fmt.Sprintf("want %s, have %s", want, indexOptions(have, partial[name]))})
+			}
+		}
+		delete(byName, "_id_")
+		for name, index := range byName {
+			drift = append(drift, IndexDrift{declared.Collection, name, "extra", indexOptions(index, partial[name])})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Collection != drift[j].Collection {
+			return drift[i].Collection < drift[j].Collection
+		}
+		return drift[i].Name < drift[j].Name
+	})
+	return drift, nil
+}
+
+func indexOptions(index mgo.Index, partial bson.M) string {
+	options := []string{}
+	if index.Unique {
+		options = append(options, "unique")
+	}
+	if partial != nil {
+		options = append(options, "partial="+fmt.Sprint(partial))
+	}
+	if index.Sparse {
+		options = append(options, "sparse")
+	}
+	if index.ExpireAfter > 0 {
+		options = append(options, "ttl="+index.ExpireAfter.String())
+	}
+	if len(options) == 0 {
+		return "(plain)"
+	}
+	return "(" + strings.Join(options, ", ") + ")"
+}
+
+// isMissingCollection reports whether err is Mongo saying the collection
+// does not exist yet, which has no indexes rather than being an error.
+func isMissingCollection(err error) bool {
+	if queryErr, ok := err.(*mgo.QueryError); ok {
+		return queryErr.Code == 26
+	}
+	return strings.Contains(err.Error(), "ns does not exist")
+}
+
+// ensureIndexesOnStartup builds the indexes and logs any drift left.
+func ensureIndexesOnStartup() error {
+	if err := ensureIndexes(dbConnection, false); err != nil {
+		return err
+	}
+	drift, err := indexDrift(dbConnection)
+	if err != nil {
+		log.Print("Cannot list indexes: ", err)
+		return nil
+	}
+	for _, d := range drift {
+		log.Print("Index drift: ", d)
+	}
+	return nil
+}
+
+// indexesCommand shows or builds the declared indexes; ensure also rebuilds
+// those whose options changed.
+func indexesCommand(args []string) error {
+	usage := errors.New("usage: indexes status|ensure [-config file]")
+	if len(args) == 0 || (args[0] != "status" && args[0] != "ensure") {
+		return usage
+	}
+	flags, configFile := commandFlags("indexes " + args[0])
+	flags.Parse(args[1:])
+	if err := openCommandStores(*configFile); err != nil {
+		return err
+	}
+	defer dbConnection.Close()
+
+	if args[0] == "ensure" {
+		if err := ensureIndexes(dbConnection, true); err != nil {
+			return err
+		}
+	}
+	drift, err := indexDrift(dbConnection)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 {
+		fmt.Println("indexes match the declared ones")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tINDEX\tPROBLEM\tDETAIL")
+	for _, d := range drift {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Collection, d.Name, d.Problem, d.Detail)
+	}
+	return w.Flush()
+}
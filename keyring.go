@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Session keyring
+//
+// Cookies are signed with a hash key and encrypted with a block key. The
+// keyring file holds one pair per line as "<id> <hash key> <block key>",
+// base64 encoded. The first pair is the primary and seals new cookies; the
+// others are only used to open cookies sealed before a rotation.
+//
+// Rotating without logging anyone out takes three steps, each followed by
+// a (rolling) restart of every instance:
+//
+//  1. `keys add` appends a new pair, which every instance learns to accept.
+//  2. `keys promote` makes it the primary, so new cookies use it.
+//  3. Once session_max_age has passed, `keys retire` drops the old pairs.
+var KEYRING_HASH_KEY_LENGTH = 64
+var KEYRING_BLOCK_KEY_LENGTH = 32
+
+type KeyPair struct {
+	ID    string
+	Hash  []byte
+	Block []byte
+}
+
+// Keyring lists key pairs with the primary first.
+type Keyring []KeyPair
+
+// newKeyPair generates a random pair, named after when it was made.
+func newKeyPair() KeyPair {
+	return KeyPair{
+		ID:    time.Now().UTC().Format("20060102T150405Z"),
+		Hash:  securecookie.GenerateRandomKey(KEYRING_HASH_KEY_LENGTH),
+		Block: securecookie.GenerateRandomKey(KEYRING_BLOCK_KEY_LENGTH)}
+}
+
+func loadKeyring(path string) (Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keyring := Keyring{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: line %d: expected <id> <hash key> <block key>", path, lineNo)
+		}
+		pair := KeyPair{ID: fields[0]}
+		if pair.Hash, err = base64.StdEncoding.DecodeString(fields[1]); err != nil || len(pair.Hash) < 32 {
+			return nil, fmt.Errorf("%s: line %d: hash key must be at least 32 bytes of base64", path, lineNo)
+		}
+		if pair.Block, err = base64.StdEncoding.DecodeString(fields[2]); err != nil ||
+			(len(pair.Block) != 16 && len(pair.Block) != 24 && len(pair.Block) != 32) {
+			return nil, fmt.Errorf("%s: line %d: block key must be 16, 24 or 32 bytes of base64", path, lineNo)
+		}
+		keyring = append(keyring, pair)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keyring, nil
+}
+
+// write replaces the keyring file in one step, readable by the owner only.
+func (k Keyring) write(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Session keyring: <id> <hash key> <block key>. The first pair seals new\n")
+	buf.WriteString("# cookies; the others only open older ones. Manage with the keys command.\n")
+	for _, pair := range k {
+		fmt.Fprintf(&buf, "%s %s %s\n", pair.ID,
+			base64.StdEncoding.EncodeToString(pair.Hash), base64.StdEncoding.EncodeToString(pair.Block))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keyring")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pairs flattens the keyring the way securecookie.CodecsFromPairs wants it.
+func (k Keyring) pairs() [][]byte {
+	pairs := [][]byte{}
+	for _, pair := range k {
+		pairs = append(pairs, pair.Hash, pair.Block)
+	}
+	return pairs
+}
+
+var errKeyringExists = errors.New("keyring already exists; use keys add to rotate")
+
+// keyringGenerate starts a keyring with a single pair.
+func keyringGenerate(path string) (Keyring, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, errKeyringExists
+	}
+	keyring := Keyring{newKeyPair()}
+	return keyring, keyring.write(path)
+}
+
+// keyringAdd appends a new verify-only pair.
+func keyringAdd(path string) (Keyring, error) {
+	keyring, err := loadKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	pair := newKeyPair()
+	for _, existing := range keyring {
+		if existing.ID == pair.ID {
+			return nil, fmt.Errorf("a key named %s already exists; try again in a second", pair.ID)
+		}
+	}
+	keyring = append(keyring, pair)
+	return keyring, keyring.write(path)
+}
+
+// keyringPromote makes the newest pair the primary; the previous primary
+// stays on to open existing cookies.
+func keyringPromote(path string) (Keyring, error) {
+	keyring, err := loadKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) < 2 {
+		return nil, errors.New("nothing to promote; run keys add first")
+	}
+	newest := keyring[len(keyring)-1]
+	keyring = append(Keyring{newest}, keyring[:len(keyring)-1]...)
+	return keyring, keyring.write(path)
+}
+
+// keyringRetire drops every pair after the first keep.
+func keyringRetire(path string, keep int) (Keyring, error) {
+	keyring, err := loadKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		return nil, errors.New("the primary key cannot be retired")
+	}
+	if keep < len(keyring) {
+		keyring = keyring[:keep]
+	}
+	return keyring, keyring.write(path)
+}
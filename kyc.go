@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KYC lifecycle
+//
+// A member's KYC status only moves along KYC_TRANSITIONS, and only through
+// changeKycStatus; handlers never write the status fields themselves.
+type KycStatus string
+type MemberStatus string
+type ScreeningStatus string
+
+var KYC_NEW = KycStatus("new")
+var KYC_IN_REVIEW = KycStatus("in_review")
+var KYC_APPROVED = KycStatus("approved")
+var KYC_REJECTED = KycStatus("rejected")
+var KYC_NEEDS_MORE_INFO = KycStatus("needs_more_info")
+var KYC_RESUBMITTED = KycStatus("resubmitted")
+
+// Status written by registration before the lifecycle existed.
+var KYC_LEGACY_PENDING = KycStatus("pending")
+
+var MEMBER_NEW = MemberStatus("new")
+var MEMBER_PROCESSED = MemberStatus("processed")
+
+var SCREENING_PENDING = ScreeningStatus("pending")
+var SCREENING_YES = ScreeningStatus("yes")
+var SCREENING_NO = ScreeningStatus("no")
+
+var KYC_TRANSITIONS = map[KycStatus][]KycStatus{
+	KYC_NEW:             {KYC_IN_REVIEW},
+	KYC_IN_REVIEW:       {KYC_APPROVED, KYC_REJECTED, KYC_NEEDS_MORE_INFO},
+	KYC_NEEDS_MORE_INFO: {KYC_RESUBMITTED},
+	KYC_REJECTED:        {KYC_RESUBMITTED},
+	KYC_RESUBMITTED:     {KYC_IN_REVIEW},
+	KYC_APPROVED:        {KYC_IN_REVIEW},
+}
+
+// Statuses that need a reason recorded with them.
+var KYC_REASON_REQUIRED = map[KycStatus]bool{
+	KYC_REJECTED:        true,
+	KYC_NEEDS_MORE_INFO: true,
+}
+
+// Statuses waiting on an admin.
+var KYC_AWAITING_REVIEW = []KycStatus{KYC_NEW, KYC_IN_REVIEW, KYC_RESUBMITTED, KYC_LEGACY_PENDING}
+
+// Decisions an admin can take at the end of a review.
+var KYC_DECISIONS = []KycStatus{KYC_APPROVED, KYC_REJECTED, KYC_NEEDS_MORE_INFO}
+
+var errKycConflict = errors.New("kyc: status was changed by someone else, reload and try again")
+
+// KycTransitionError reports a status change the lifecycle does not allow.
+type KycTransitionError struct {
+	From KycStatus
+	To   KycStatus
+}
+
+func (e *KycTransitionError) Error() string {
+	return fmt.Sprintf("kyc: cannot move from %s to %s", e.From, e.To)
+}
+
+func (s KycStatus) Label() string {
+	return strings.Replace(string(s), "_", " ", -1)
+}
+
+func (s KycStatus) valid() bool {
+	_, ok := KYC_TRANSITIONS[s]
+	return ok
+}
+
+func (s ScreeningStatus) valid() bool {
+	return s == SCREENING_PENDING || s == SCREENING_YES || s == SCREENING_NO
+}
+
+func canTransition(from, to KycStatus) bool {
+	for _, next := range KYC_TRANSITIONS[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// currentKycStatus maps records written before the lifecycle onto it.
+func currentKycStatus(person Person) KycStatus {
+	switch person.Kycstatus {
+	case "", KYC_LEGACY_PENDING:
+		if person.Memberstatus == MEMBER_PROCESSED {
+			return KYC_IN_REVIEW
+		}
+		return KYC_NEW
+	}
+	return person.Kycstatus
+}
+
+// KycChange is a requested status change plus what the admin recorded
+// alongside it. Screening and payment fields are left as they are when empty.
+type KycChange struct {
+	To       KycStatus
+	Reason   string
+	Aml      ScreeningStatus
+	Cft      ScreeningStatus
+	Chequeno string
+	Bankname string
+	// Amount is as entered; validate checks it reads as Money.
+	Amount string
+}
+
+func (change *KycChange) validate() error {
+	change.Reason = strings.TrimSpace(change.Reason)
+	if KYC_REASON_REQUIRED[change.To] && change.Reason == "" {
+		return fmt.Errorf("kyc: a reason is required to mark a member %s", change.To.Label())
+	}
+	if change.Aml != "" && !change.Aml.valid() || change.Cft != "" && !change.Cft.valid() {
+		return errors.New("kyc: AML and CFT must be pending, yes or no")
+	}
+	if change.Amount != "" {
+		if _, err := parseMoney(change.Amount); err != nil {
+			return fmt.Errorf("kyc: %v", err)
+		}
+	}
+	return nil
+}
+
+// changeKycStatus validates change against the member's current status and
+// stores it. Every handler that changes KYC status goes through here.
+func changeKycStatus(username string, change KycChange) error {
+	return updateKycStatus(username, change, false)
+}
+
+// updateKycStatus is changeKycStatus; with throughReview the change may
+// also be one that is allowed once the review is opened, and is then made
+// in the same single update.
+func updateKycStatus(username string, change KycChange, throughReview bool) error {
+	person, err := personStore.Get(username)
+	if err != nil {
+		return err
+	}
+	decision, err := planKycChange(person, change, throughReview)
+	if err != nil {
+		return err
+	}
+	return storeKycDecision(person, decision)
+}
+
+// planKycChange checks change against person's current status, as
+// updateKycStatus does, and returns the fields it would write. Handlers
+// that audit a change before making it plan it first.
+func planKycChange(person Person, change KycChange, throughReview bool) (KycDecision, error) {
+	from := currentKycStatus(person)
+	allowed := canTransition(from, change.To)
+	if !allowed && throughReview && canTransition(from, KYC_IN_REVIEW) {
+		allowed = canTransition(KYC_IN_REVIEW, change.To)
+	}
+	if !change.To.valid() || !allowed {
+		return KycDecision{}, &KycTransitionError{from, change.To}
+	}
+	if err := change.validate(); err != nil {
+		return KycDecision{}, err
+	}
+
+	decision := KycDecision{
+		Memberstatus: person.Memberstatus,
+		Kycstatus:    change.To,
+		Kycreason:    change.Reason,
+		Aml:          person.Aml,
+		Cft:          person.Cft,
+		Chequeno:     person.Chequeno,
+		Bankname:     person.Bankname,
+		Amount:       person.Amount}
+	if change.To != KYC_IN_REVIEW && change.To != KYC_RESUBMITTED {
+		decision.Memberstatus = MEMBER_PROCESSED
+	}
+	if change.Aml != "" {
+		decision.Aml = change.Aml
+	}
+	if change.Cft != "" {
+		decision.Cft = change.Cft
+	}
+	if change.Chequeno != "" || change.Bankname != "" || change.Amount != "" {
+		decision.Chequeno = change.Chequeno
+		decision.Bankname = change.Bankname
+		decision.Amount = Money{}
+		if change.Amount != "" {
+			// checked by validate
+			decision.Amount, _ = parseMoney(change.Amount)
+		}
+	}
+	return decision, nil
+}
+
+// storeKycDecision writes a decision planned from person, failing with
+// errKycConflict if the status changed since person was read.
+func storeKycDecision(person Person, decision KycDecision) error {
+	err := personStore.UpdateKyc(person.Username, person.Kycstatus, decision)
+	if err == errNotFound {
+		return errKycConflict
+	} else if err != nil {
+		return err
+	}
+	revokeSessions(USER_SESSION, person.Username)
+	return nil
+}
+
+// reviewKyc plans an admin decision. A member still waiting for review
+// goes straight to the decision, as if the review had been opened first;
+// the whole move is refused unless it is allowed.
+func reviewKyc(person Person, change KycChange) (KycDecision, error) {
+	return planKycChange(person, change, true)
+}
+
+// resubmitKyc puts a member's KYC back in front of an admin after they
+// changed something it was based on. An approval goes back into review, a
+// rejection or request for more information becomes a resubmission, and a
+// member still waiting for review stays where they are. With rescreen the
+// AML and CFT checks start over too.
+func resubmitKyc(username string, rescreen bool) error {
+	person, err := personStore.Get(username)
+	if err != nil {
+		return err
+	}
+	change, ok := kycResubmission(person, rescreen)
+	if !ok {
+		return nil
+	}
+	return changeKycStatus(username, change)
+}
+
+// kycResubmission is the change resubmitKyc makes for person, if any.
+func kycResubmission(person Person, rescreen bool) (KycChange, bool) {
+	change := KycChange{}
+	switch currentKycStatus(person) {
+	case KYC_APPROVED:
+		change.To = KYC_IN_REVIEW
+	case KYC_REJECTED, KYC_NEEDS_MORE_INFO:
+		change.To = KYC_RESUBMITTED
+	default:
+		return change, false
+	}
+	if rescreen {
+		change.Aml = SCREENING_PENDING
+		change.Cft = SCREENING_PENDING
+	}
+	return change, true
+}
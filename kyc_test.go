@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from KycStatus
+		to   KycStatus
+		ok   bool
+	}{
+		{KYC_NEW, KYC_IN_REVIEW, true},
+		{KYC_NEW, KYC_APPROVED, false},
+		{KYC_IN_REVIEW, KYC_APPROVED, true},
+		{KYC_IN_REVIEW, KYC_REJECTED, true},
+		{KYC_IN_REVIEW, KYC_NEEDS_MORE_INFO, true},
+		{KYC_IN_REVIEW, KYC_RESUBMITTED, false},
+		{KYC_NEEDS_MORE_INFO, KYC_RESUBMITTED, true},
+		{KYC_NEEDS_MORE_INFO, KYC_APPROVED, false},
+		{KYC_REJECTED, KYC_RESUBMITTED, true},
+		{KYC_RESUBMITTED, KYC_IN_REVIEW, true},
+		{KYC_RESUBMITTED, KYC_APPROVED, false},
+		{KYC_APPROVED, KYC_IN_REVIEW, true},
+		{KYC_APPROVED, KYC_REJECTED, false},
+		{KYC_LEGACY_PENDING, KYC_IN_REVIEW, false},
+	}
+	for _, test := range tests {
+		if got := canTransition(test.from, test.to); got != test.ok {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", test.from, test.to, got, test.ok)
+		}
+	}
+}
+
+func TestCurrentKycStatus(t *testing.T) {
+	tests := []struct {
+		person Person
+		want   KycStatus
+	}{
+		{Person{}, KYC_NEW},
+		{Person{Kycstatus: KYC_LEGACY_PENDING}, KYC_NEW},
+		{Person{Kycstatus: KYC_LEGACY_PENDING, Memberstatus: MEMBER_PROCESSED}, KYC_IN_REVIEW},
+		{Person{Kycstatus: KYC_APPROVED, Memberstatus: MEMBER_PROCESSED}, KYC_APPROVED},
+	}
+	for _, test := range tests {
+		if got := currentKycStatus(test.person); got != test.want {
+			t.Errorf("currentKycStatus(%s, %s) = %s, want %s", test.person.Kycstatus, test.person.Memberstatus, got, test.want)
+		}
+	}
+}
+
+func TestKycChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   KycStatus
+		review bool
+		change KycChange
+		want   KycStatus
+		ok     bool
+	}{
+		{"open review", KYC_NEW, false, KycChange{To: KYC_IN_REVIEW}, KYC_IN_REVIEW, true},
+		{"decide without review", KYC_NEW, false, KycChange{To: KYC_APPROVED}, KYC_NEW, false},
+		{"decide", KYC_IN_REVIEW, false, KycChange{To: KYC_APPROVED}, KYC_APPROVED, true},
+		{"reject without reason", KYC_IN_REVIEW, false, KycChange{To: KYC_REJECTED, Reason: " "}, KYC_IN_REVIEW, false},
+		{"reject", KYC_IN_REVIEW, false, KycChange{To: KYC_REJECTED, Reason: "Blurred passport"}, KYC_REJECTED, true},
+		{"unknown status", KYC_IN_REVIEW, false, KycChange{To: "done"}, KYC_IN_REVIEW, false},
+		{"bad screening", KYC_IN_REVIEW, false, KycChange{To: KYC_APPROVED, Aml: "maybe"}, KYC_IN_REVIEW, false},
+		{"bad amount", KYC_IN_REVIEW, false, KycChange{To: KYC_APPROVED, Amount: "lots"}, KYC_IN_REVIEW, false},
+		{"review new", KYC_NEW, true, KycChange{To: KYC_APPROVED}, KYC_APPROVED, true},
+		{"review legacy", KYC_LEGACY_PENDING, true, KycChange{To: KYC_NEEDS_MORE_INFO, Reason: "Proof of address"}, KYC_NEEDS_MORE_INFO, true},
+		{"review resubmitted", KYC_RESUBMITTED, true, KycChange{To: KYC_APPROVED}, KYC_APPROVED, true},
+		{"review without reason", KYC_NEW, true, KycChange{To: KYC_REJECTED}, KYC_NEW, false},
+		{"review to resubmitted", KYC_NEW, true, KycChange{To: KYC_RESUBMITTED}, KYC_NEW, false},
+		{"review waiting on member", KYC_NEEDS_MORE_INFO, true, KycChange{To: KYC_APPROVED}, KYC_NEEDS_MORE_INFO, false},
+	}
+	for _, test := range tests {
+		useMemoryStores(t)
+		if err := personStore.Insert(&Person{Username: "ann", Kycstatus: test.from, Memberstatus: MEMBER_NEW}); err != nil {
+			t.Fatal(err)
+		}
+		before, err := personStore.Get("ann")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = updateKycStatus("ann", test.change, test.review)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error = %v, want ok %v", test.name, err, test.ok)
+		}
+		after, err := personStore.Get("ann")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Kycstatus != test.want {
+			t.Errorf("%s: status = %s, want %s", test.name, after.Kycstatus, test.want)
+		}
+		if !test.ok && !reflect.DeepEqual(before, after) {
+			t.Errorf("%s: a refused change was written: %+v", test.name, after)
+		}
+	}
+}
+
+func TestKycConflict(t *testing.T) {
+	useMemoryStores(t)
+	if err := personStore.Insert(&Person{Username: "ann", Kycstatus: KYC_IN_REVIEW}); err != nil {
+		t.Fatal(err)
+	}
+	// another admin decides between this one reading the member and writing
+	err := personStore.UpdateKyc("ann", KYC_NEW, KycDecision{Kycstatus: KYC_APPROVED})
+	if err != errNotFound {
+		t.Errorf("UpdateKyc from a stale status = %v, want errNotFound", err)
+	}
+}
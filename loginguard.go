@@ -0,0 +1,322 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Login throttling
+//
+// Failed logins are counted per username and per client IP. Each failure
+// for a username doubles the wait before it may try again, starting at
+// LOGIN_BACKOFF; LOGIN_MAX_FAILURES for a username, or LOGIN_IP_MAX_FAILURES
+// from one IP, locks it out for LOGIN_LOCKOUT. Counts start over once
+// LOGIN_LOCKOUT passes without a failure. Blocked attempts get the same
+// "Invalid email or password." as any other failure, for usernames that
+// exist or not, so nothing can be learned from them.
+var loginAttemptStore LoginAttemptStore
+
+var DB_COLLECTION_LOGIN_ATTEMPT string
+var LOGIN_MAX_FAILURES int
+var LOGIN_IP_MAX_FAILURES int
+var LOGIN_BACKOFF time.Duration
+var LOGIN_LOCKOUT time.Duration
+
+var LOGIN_KIND_IP = "ip"
+
+var LOGIN_FAILED_MESSAGE = "Invalid email or password."
+
+// LoginAttempts counts recent failures for a username of one kind (USER_PERSON
+// or USER_ADMIN) or for an IP.
+type LoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Kind        string    `bson:"kind"`
+	Name        string    `bson:"name"`
+	Failures    int       `bson:"failures"`
+	Last        time.Time `bson:"last"`
+	Lockeduntil time.Time `bson:"lockeduntil"`
+}
+
+func loginAttemptKey(kind string, name string) string {
+	return kind + ":" + name
+}
+
+// blockedUntil is when the next attempt is allowed.
+func (a LoginAttempts) blockedUntil() time.Time {
+	until := a.Lockeduntil
+	if a.Kind != LOGIN_KIND_IP && a.Failures > 0 {
+		backoff := LOGIN_BACKOFF << uint(a.Failures-1)
+		if backoff > LOGIN_LOCKOUT || backoff <= 0 {
+			backoff = LOGIN_LOCKOUT
+		}
+		if wait := a.Last.Add(backoff); wait.After(until) {
+			until = wait
+		}
+	}
+	return until
+}
+
+func (a LoginAttempts) Locked() bool {
+	return a.Lockeduntil.After(time.Now())
+}
+
+type LoginAttemptStore interface {
+	Get(key string) (LoginAttempts, error)
+	// Fail counts a failure for kind and name at the time at in one update,
+	// starting the count over if the last failure is older than
+	// LOGIN_LOCKOUT and no lockout is running, and returns the record as it
+	// is afterwards.
+	Fail(kind string, name string, at time.Time) (LoginAttempts, error)
+	// Lock locks key out until until, unless a lockout is running at the
+	// time at, and reports whether it did.
+	Lock(key string, at time.Time, until time.Time) (bool, error)
+	Delete(key string) error
+	// List returns every record with failures in the last LOGIN_LOCKOUT or a
+	// lockout still running.
+	List() ([]LoginAttempts, error)
+}
+
+// Mongo implementation
+
+type mgoLoginAttemptStore struct{ mgoCollection }
+
+func newMgoLoginAttemptStore(session *mgo.Session) *mgoLoginAttemptStore {
+	return &mgoLoginAttemptStore{mgoCollection{session, DB_COLLECTION_LOGIN_ATTEMPT}}
+}
+
+func (s *mgoLoginAttemptStore) Get(key string) (attempts LoginAttempts, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.FindId(key).One(&attempts)
+	})
+	return
+}
+
+func (s *mgoLoginAttemptStore) Fail(kind string, name string, at time.Time) (attempts LoginAttempts, err error) {
+	key := loginAttemptKey(kind, name)
+	err = s.with(func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": key, "last": bson.M{"$lt": at.Add(-LOGIN_LOCKOUT)}, "lockeduntil": bson.M{"$lt": at}},
+			bson.M{"$set": bson.M{"failures": 0}})
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		change := mgo.Change{
+			Update: bson.M{
+				"$inc":         bson.M{"failures": 1},
+				"$set":         bson.M{"kind": kind, "name": name, "last": at},
+				"$setOnInsert": bson.M{"lockeduntil": time.Time{}}},
+			Upsert:    true,
+			ReturnNew: true}
+		_, err = c.FindId(key).Apply(change, &attempts)
+		if mgo.IsDup(err) {
+			// another failure inserted the record first; this one can
+			// only update it
+			_, err = c.FindId(key).Apply(change, &attempts)
+		}
+		return err
+	})
+	return
+}
+
+func (s *mgoLoginAttemptStore) Lock(key string, at time.Time, until time.Time) (locked bool, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": key, "lockeduntil": bson.M{"$lte": at}}, bson.M{"$set": bson.M{"lockeduntil": until}})
+		locked = err == nil
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+func (s *mgoLoginAttemptStore) Delete(key string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.RemoveId(key)
+	})
+}
+
+func (s *mgoLoginAttemptStore) List() (list []LoginAttempts, err error) {
+	now := time.Now()
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"$or": []bson.M{
+			{"last": bson.M{"$gt": now.Add(-LOGIN_LOCKOUT)}},
+			{"lockeduntil": bson.M{"$gt": now}}}}).Sort("-last").All(&list)
+	})
+	return
+}
+
+// In-memory implementation
+
+type memoryLoginAttemptStore struct {
+	docs *memoryCollection
+	// held across the read and write of Fail and Lock
+	mu sync.Mutex
+}
+
+func newMemoryLoginAttemptStore() *memoryLoginAttemptStore {
+	return &memoryLoginAttemptStore{docs: newMemoryCollection()}
+}
+
+func (s *memoryLoginAttemptStore) Get(key string) (attempts LoginAttempts, err error) {
+	err = s.docs.findOne(bson.M{"_id": key}, &attempts)
+	return
+}
+
+func (s *memoryLoginAttemptStore) Fail(kind string, name string, at time.Time) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := loginAttemptKey(kind, name)
+	attempts, err := s.Get(key)
+	if err == errNotFound {
+		attempts = LoginAttempts{Key: key, Kind: kind, Name: name}
+		if err := s.docs.insert(attempts); err != nil {
+			return attempts, err
+		}
+	} else if err != nil {
+		return attempts, err
+	}
+	if attempts.Last.Before(at.Add(-LOGIN_LOCKOUT)) && !attempts.Lockeduntil.After(at) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.Last = at
+	return attempts, s.docs.update(bson.M{"_id": key}, bson.M{"failures": attempts.Failures, "last": attempts.Last})
+}
+
+func (s *memoryLoginAttemptStore) Lock(key string, at time.Time, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.Get(key)
+	if err == errNotFound || (err == nil && attempts.Lockeduntil.After(at)) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, s.docs.update(bson.M{"_id": key}, bson.M{"lockeduntil": until})
+}
+
+func (s *memoryLoginAttemptStore) Delete(key string) error {
+	return s.docs.remove(bson.M{"_id": key})
+}
+
+func (s *memoryLoginAttemptStore) List() ([]LoginAttempts, error) {
+	var all []LoginAttempts
+	if err := s.docs.findAll(bson.M{}, nil, &all); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	recent := []LoginAttempts{}
+	for _, attempts := range all {
+		if attempts.Last.After(now.Add(-LOGIN_LOCKOUT)) || attempts.Lockeduntil.After(now) {
+			recent = append(recent, attempts)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i].Last.After(recent[j].Last) })
+	return recent, nil
+}
+
+// loginAttempts returns the current record for kind and name, starting over
+// if the last failure is older than LOGIN_LOCKOUT.
+func loginAttempts(kind string, name string) (LoginAttempts, error) {
+	key := loginAttemptKey(kind, name)
+	attempts, err := loginAttemptStore.Get(key)
+	if err == errNotFound || (err == nil && time.Since(attempts.Last) > LOGIN_LOCKOUT && !attempts.Locked()) {
+		return LoginAttempts{Key: key, Kind: kind, Name: name}, nil
+	}
+	return attempts, err
+}
+
+// loginBlocked reports whether a login for username of kind from req's
+// client must be turned away without checking the password.
+func loginBlocked(req *http.Request, kind string, username string) bool {
+	now := time.Now()
+	for _, key := range [][2]string{{kind, username}, {LOGIN_KIND_IP, clientIP(req)}} {
+		attempts, err := loginAttempts(key[0], key[1])
+		if err != nil {
+			log.Print("Error reading login attempts: ", err)
+			continue
+		}
+		if attempts.blockedUntil().After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginFailed counts a failed login against username and req's client, and
+// locks either out when it reaches its limit.
+func loginFailed(req *http.Request, kind string, username string) {
+	now := time.Now()
+	limits := []struct {
+		kind string
+		name string
+		max  int
+	}{{kind, username, LOGIN_MAX_FAILURES}, {LOGIN_KIND_IP, clientIP(req), LOGIN_IP_MAX_FAILURES}}
+	for _, limit := range limits {
+		attempts, err := loginAttemptStore.Fail(limit.kind, limit.name, now)
+		if err != nil {
+			log.Print("Error saving login attempts: ", err)
+			continue
+		}
+		if attempts.Failures < limit.max {
+			continue
+		}
+		// of the failures that reach the limit at once, only the one that
+		// starts the lockout records it
+		locked, err := loginAttemptStore.Lock(attempts.Key, now, now.Add(LOGIN_LOCKOUT))
+		if err != nil {
+			log.Print("Error saving login attempts: ", err)
+			continue
+		}
+		if locked {
+			if err := recordAudit(req, AUDIT_LOGIN_LOCKOUT, limit.name, limit.kind, nil, nil); err != nil {
+				log.Print("Error writing audit entry: ", err)
+			}
+		}
+	}
+}
+
+// loginSucceeded clears username's failures. The IP's count stays, so one
+// valid account cannot be used to keep guessing others.
+func loginSucceeded(kind string, username string) {
+	if err := loginAttemptStore.Delete(loginAttemptKey(kind, username)); err != nil && err != errNotFound {
+		log.Print("Error clearing login attempts: ", err)
+	}
+}
+
+// lockoutsPageHandler lists usernames and IPs with recent failures, for an
+// admin to unlock.
+func lockoutsPageHandler(res http.ResponseWriter, req *http.Request) error {
+	list, err := loginAttemptStore.List()
+	if err != nil {
+		return err
+	}
+	return renderTemplate(res, req, http.StatusOK, "lockouts.html", map[string]interface{}{"attempts": list})
+}
+
+func lockoutsSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	attempts, err := loginAttemptStore.Get(req.FormValue("key"))
+	if err == errNotFound {
+		http.Redirect(res, req, "/lockouts", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := recordAudit(req, AUDIT_LOGIN_UNLOCK, attempts.Name, attempts.Kind, nil, nil); err != nil {
+		return err
+	}
+	if err := loginAttemptStore.Delete(attempts.Key); err != nil && err != errNotFound {
+		return err
+	}
+	http.Redirect(res, req, "/lockouts", http.StatusSeeOther)
+	return nil
+}
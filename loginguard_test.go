@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func useLoginLimits(t *testing.T) {
+	t.Helper()
+	max, ipMax, backoff, lockout := LOGIN_MAX_FAILURES, LOGIN_IP_MAX_FAILURES, LOGIN_BACKOFF, LOGIN_LOCKOUT
+	LOGIN_MAX_FAILURES, LOGIN_IP_MAX_FAILURES, LOGIN_BACKOFF, LOGIN_LOCKOUT = 3, 10, time.Second, time.Hour
+	t.Cleanup(func() {
+		LOGIN_MAX_FAILURES, LOGIN_IP_MAX_FAILURES, LOGIN_BACKOFF, LOGIN_LOCKOUT = max, ipMax, backoff, lockout
+	})
+}
+
+func TestBlockedUntil(t *testing.T) {
+	useLoginLimits(t)
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		attempts LoginAttempts
+		want     time.Time
+	}{
+		{LoginAttempts{Kind: USER_PERSON}, time.Time{}},
+		{LoginAttempts{Kind: USER_PERSON, Failures: 1, Last: last}, last.Add(time.Second)},
+		{LoginAttempts{Kind: USER_PERSON, Failures: 4, Last: last}, last.Add(8 * time.Second)},
+		{LoginAttempts{Kind: USER_PERSON, Failures: 20, Last: last}, last.Add(time.Hour)},
+		{LoginAttempts{Kind: USER_PERSON, Failures: 80, Last: last}, last.Add(time.Hour)},
+		{LoginAttempts{Kind: USER_PERSON, Failures: 1, Last: last, Lockeduntil: last.Add(time.Minute)}, last.Add(time.Minute)},
+		{LoginAttempts{Kind: LOGIN_KIND_IP, Failures: 4, Last: last}, time.Time{}},
+		{LoginAttempts{Kind: LOGIN_KIND_IP, Failures: 4, Last: last, Lockeduntil: last.Add(time.Minute)}, last.Add(time.Minute)},
+	}
+	for _, test := range tests {
+		if got := test.attempts.blockedUntil(); !got.Equal(test.want) {
+			t.Errorf("blockedUntil(%s, %d failures) = %v, want %v", test.attempts.Kind, test.attempts.Failures, got, test.want)
+		}
+	}
+}
+
+func TestLoginAttemptStore(t *testing.T) {
+	useLoginLimits(t)
+	useMemoryStores(t)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := loginAttemptKey(USER_PERSON, "ann")
+	steps := []struct {
+		name     string
+		fail     bool
+		lock     bool
+		at       time.Time
+		failures int
+		locked   bool
+	}{
+		{"first failure", true, false, start, 1, false},
+		{"second failure", true, false, start.Add(time.Minute), 2, false},
+		{"lock", false, true, start.Add(time.Minute), 2, true},
+		{"lock again", false, true, start.Add(2 * time.Minute), 2, false},
+		{"failure while locked", true, false, start.Add(3 * time.Minute), 3, false},
+		{"lock after lockout", false, true, start.Add(70 * time.Minute), 3, true},
+		{"stale count", true, false, start.Add(4 * time.Hour), 1, false},
+	}
+	for _, step := range steps {
+		if step.fail {
+			attempts, err := loginAttemptStore.Fail(USER_PERSON, "ann", step.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempts.Failures != step.failures || attempts.Key != key {
+				t.Errorf("%s: Fail = %s with %d failures, want %s with %d", step.name, attempts.Key, attempts.Failures, key, step.failures)
+			}
+		}
+		if step.lock {
+			locked, err := loginAttemptStore.Lock(key, step.at, step.at.Add(LOGIN_LOCKOUT))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if locked != step.locked {
+				t.Errorf("%s: Lock = %v, want %v", step.name, locked, step.locked)
+			}
+		}
+	}
+	if locked, err := loginAttemptStore.Lock(loginAttemptKey(USER_PERSON, "bob"), start, start.Add(time.Hour)); locked || err != nil {
+		t.Errorf("Lock with no failures = %v, %v, want false, nil", locked, err)
+	}
+}
+
+func TestLoginFailedLocksOut(t *testing.T) {
+	useLoginLimits(t)
+	useMemoryStores(t)
+	req := httptest.NewRequest("POST", "/login", nil)
+	for i := 0; i < LOGIN_MAX_FAILURES+2; i++ {
+		loginFailed(req, USER_PERSON, "ann")
+	}
+	attempts, err := loginAttempts(USER_PERSON, "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Failures != LOGIN_MAX_FAILURES+2 || !attempts.Locked() {
+		t.Errorf("after %d failures: %d counted, locked %v", LOGIN_MAX_FAILURES+2, attempts.Failures, attempts.Locked())
+	}
+	if !loginBlocked(req, USER_PERSON, "ann") {
+		t.Error("a locked out username is not blocked")
+	}
+	if loginBlocked(req, USER_PERSON, "bob") {
+		t.Error("another username is blocked")
+	}
+	entries, err := auditStore.List(AuditFilter{Action: AUDIT_LOGIN_LOCKOUT}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d lockouts audited, want 1", len(entries))
+	}
+
+	loginSucceeded(USER_PERSON, "ann")
+	if attempts, _ := loginAttempts(USER_PERSON, "ann"); attempts.Failures != 0 {
+		t.Errorf("after logging in, %d failures are still counted", attempts.Failures)
+	}
+}
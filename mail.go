@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Outbound mail
+//
+// Handlers send mail through mailer, which is picked by mail_transport:
+// "smtp" for real delivery, "file" to drop each message into mail_dir as a
+// .eml file, or "memory" to keep them in the process and log them. The
+// last two are for local testing. Bodies are text templates in view/mail.
+var mailer Mailer
+
+var MAIL_TRANSPORT_SMTP = "smtp"
+var MAIL_TRANSPORT_FILE = "file"
+var MAIL_TRANSPORT_MEMORY = "memory"
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// message renders mail with its headers. Header values lose any line
+// breaks so a crafted address or subject cannot add headers of its own.
+func (m Mail) message(from string) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", header.Replace(m.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", header.Replace(m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// newSmtpMailer sends through the server at addr, logging in only when a
+// username is given.
+func newSmtpMailer(addr string, username string, password string, from string) *smtpMailer {
+	mailer := &smtpMailer{addr: addr, from: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *smtpMailer) Send(mail Mail) error {
+	return smtp.SendMail(m.addr, m.auth, envelopeAddress(m.from), []string{envelopeAddress(mail.To)}, mail.message(m.from))
+}
+
+// envelopeAddress strips a display name, "Name <addr>" becoming "addr".
+func envelopeAddress(address string) string {
+	if i := strings.LastIndex(address, "<"); i >= 0 && strings.HasSuffix(address, ">") {
+		return address[i+1 : len(address)-1]
+	}
+	return address
+}
+
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func newFileMailer(dir string, from string) (*fileMailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileMailer{dir, from}, nil
+}
+
+func (m *fileMailer) Send(mail Mail) error {
+	name := fmt.Sprintf("%s-%x.eml", time.Now().UTC().Format("20060102T150405Z"), securecookie.GenerateRandomKey(4))
+	path := filepath.Join(m.dir, name)
+	if err := ioutil.WriteFile(path, mail.message(m.from), 0600); err != nil {
+		return err
+	}
+	log.Printf("Mail to %s written to %s", mail.To, path)
+	return nil
+}
+
+type memoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func newMemoryMailer() *memoryMailer {
+	return &memoryMailer{}
+}
+
+func (m *memoryMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	m.sent = append(m.sent, mail)
+	m.mu.Unlock()
+	log.Printf("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// sendTemplateMail renders the mail template name with data and sends it
+// to to.
+func sendTemplateMail(to string, subject string, name string, data interface{}) error {
+	body, err := executeMailTemplate(name, data)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(Mail{To: to, Subject: subject, Body: body})
+}
+
+// openMailer sets up mailer for config's mail_transport.
+func openMailer(config Config) (err error) {
+	switch config.MailTransport {
+	case MAIL_TRANSPORT_SMTP:
+		mailer = newSmtpMailer(config.SmtpAddr, config.SmtpUsername, config.SmtpPassword, config.MailFrom)
+	case MAIL_TRANSPORT_FILE:
+		mailer, err = newFileMailer(config.MailDir, config.MailFrom)
+	default:
+		mailer = newMemoryMailer()
+	}
+	return err
+}
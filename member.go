@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Member self-service
+//
+// Members keep their own details, password and documents up to date.
+// Changing an identity field or uploading a document sends their KYC back
+// to an admin (see resubmitKyc); contact details can change freely.
+
+// personProfile returns the editable part of person.
+func personProfile(person Person) PersonProfile {
+	return PersonProfile{
+		Name:        person.Name,
+		Gender:      person.Gender,
+		Dob:         person.Dob,
+		Nationality: person.Nationality,
+		Address1:    person.Address1,
+		Address2:    person.Address2,
+		Country:     person.Country,
+		Passport:    person.Passport,
+		Mobile:      person.Mobile}
+}
+
+// identityChanged reports whether any field KYC checked differs in other.
+func (p PersonProfile) identityChanged(other PersonProfile) bool {
+	return p.Name != other.Name || p.Gender != other.Gender || !p.Dob.Equal(other.Dob) ||
+		p.Nationality != other.Nationality || p.Passport != other.Passport
+}
+
+func profilePageHandler(res http.ResponseWriter, req *http.Request) error {
+	person := currentMember(req)
+	return renderProfilePage(res, req, http.StatusOK, personProfile(*person), person.Email, nil)
+}
+
+func profileSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	username := currentMember(req).Username
+	errs := FieldErrors{}
+	profile, email := readMemberDetails(req, errs)
+	if _, ok := errs["email"]; !ok {
+		if other, err := personStore.GetByEmail(email); err == nil && other.Username != username {
+			errs["email"] = "An account with this email address already exists."
+		}
+	}
+	if len(errs) > 0 {
+		return renderProfilePage(res, req, http.StatusBadRequest, profile, email, errs)
+	}
+	before, err := personStore.Get(username)
+	if err != nil {
+		return err
+	}
+	// the audit entry is written first, so work out the whole change
+	after := before
+	profile.apply(&after)
+	emailChanged := !strings.EqualFold(email, before.Email)
+	if emailChanged {
+		after.Email = email
+		after.Emailverified = false
+	}
+	identityChanged := profile.identityChanged(personProfile(before))
+	var decision *KycDecision
+	if change, ok := kycResubmission(before, true); ok && identityChanged {
+		planned, err := planKycChange(before, change, false)
+		if err != nil {
+			return err
+		}
+		planned.apply(&after)
+		decision = &planned
+	}
+	if err := recordAudit(req, AUDIT_PROFILE_UPDATE, username, "", before, after); err != nil {
+		return err
+	}
+
+	notice := "Your details have been saved."
+	if emailChanged {
+		if err := personStore.UpdateEmail(username, email); err != nil {
+			if _, ok := err.(*duplicateError); ok {
+				errs["email"] = "An account with this email address already exists."
+				return renderProfilePage(res, req, http.StatusBadRequest, profile, email, errs)
+			}
+			return err
+		}
+		if err := sendVerificationMail(after); err != nil {
+			log.Print("Error sending verification mail: ", err)
+		}
+		notice += " Please verify your new email address with the link we sent to it."
+	}
+	if err := personStore.UpdateProfile(username, profile); err != nil {
+		return err
+	}
+	if decision != nil {
+		if err := storeKycDecision(before, *decision); err != nil {
+			return err
+		}
+	}
+	if identityChanged {
+		notice += " As your identity details changed, your KYC will be reviewed again."
+	}
+	memberNotice(res, req, "/profile", notice)
+	return nil
+}
+
+func renderProfilePage(res http.ResponseWriter, req *http.Request, status int, profile PersonProfile, email string, errs FieldErrors) error {
+	return renderTemplate(res, req, status, "profile.html", map[string]interface{}{
+		"profile": profile,
+		"email":   email,
+		"person":  currentMember(req),
+		"errors":  errs,
+		"notice":  takeNotice(res, req)})
+}
+
+func changePasswordPageHandler(res http.ResponseWriter, req *http.Request) error {
+	return renderChangePasswordPage(res, req, "")
+}
+
+// changePasswordSubmitHandler needs the current password, and counts wrong
+// ones like failed logins so a borrowed session cannot be used to guess it.
+func changePasswordSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	username := currentMember(req).Username
+	if loginBlocked(req, USER_PERSON, username) {
+		return renderChangePasswordPage(res, req, "Too many wrong passwords. Please try again later.")
+	}
+	before, err := personStore.Get(username)
+	if err != nil {
+		return err
+	}
+	if match, _ := verifyPassword(before.Password, req.FormValue("current")); !match {
+		loginFailed(req, USER_PERSON, username)
+		return renderChangePasswordPage(res, req, "Your current password is not correct.")
+	}
+	password := req.FormValue("password")
+	if problem := checkNewPassword(password, req.FormValue("confirm"), before.Username, before.Email); problem != "" {
+		return renderChangePasswordPage(res, req, problem)
+	}
+	if err := changeMemberPassword(username, password); err != nil {
+		return err
+	}
+	loginSucceeded(USER_PERSON, username)
+	after, err := personStore.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(req, AUDIT_PASSWORD_CHANGE, username, "", before, after); err != nil {
+		return err
+	}
+	memberNotice(res, req, "/profile", "Your password has been changed and your other devices have been logged out.")
+	return nil
+}
+
+func renderChangePasswordPage(res http.ResponseWriter, req *http.Request, message string) error {
+	return renderTemplate(res, req, http.StatusOK, "change_password.html", map[string]interface{}{"person": currentMember(req), "message": message})
+}
+
+func memberDocumentsPageHandler(res http.ResponseWriter, req *http.Request) error {
+	return renderMemberDocumentsPage(res, req, http.StatusOK, nil)
+}
+
+// memberDocumentsSubmitHandler takes a new or replacement document.
+// Earlier ones stay on record for the reviewer.
+func memberDocumentsSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	limitUploadBody(res, req)
+	errs := FieldErrors{}
+	if err := parseUploadForm(req, "document", errs); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	upload := readDocumentUpload(req, "document", errs)
+	documentType := req.FormValue("documenttype")
+	if !isDocumentType(documentType) {
+		errs["documenttype"] = "Please choose a document type."
+	}
+	issueDate, expiryDate := readDocumentDates(req, errs)
+	if len(errs) > 0 {
+		return renderMemberDocumentsPage(res, req, http.StatusBadRequest, errs)
+	}
+	username := currentMember(req).Username
+	document, err := storeMemberDocument(username, documentType, upload, issueDate, expiryDate)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(req, AUDIT_DOCUMENT_UPLOAD, username, document.ID.Hex(), nil, document); err != nil {
+		return err
+	}
+	if err := resubmitKyc(username, false); err != nil {
+		return err
+	}
+	memberNotice(res, req, "/my-documents", "Thanks, your document has been uploaded and will be reviewed.")
+	return nil
+}
+
+func renderMemberDocumentsPage(res http.ResponseWriter, req *http.Request, status int, errs FieldErrors) error {
+	person := currentMember(req)
+	documents, err := documentStore.ListByMember(person.Username)
+	if err != nil {
+		return err
+	}
+	return renderTemplate(res, req, status, "member_documents.html", map[string]interface{}{
+		"person":        person,
+		"documents":     documents,
+		"documentTypes": DOCUMENT_TYPES,
+		"errors":        errs,
+		"notice":        takeNotice(res, req)})
+}
+
+// memberNotice shows notice on the member's next page, at path. Password
+// and KYC changes revoke all of a member's sessions; the one that made the
+// change carries on under a new ID.
+func memberNotice(res http.ResponseWriter, req *http.Request, path string, notice string) {
+	session, _ := STORE.Get(req, USER_SESSION)
+	if _, err := sessionStore.Get(session.ID); err == errNotFound {
+		renewSession(session)
+	}
+	session.AddFlash(notice, NOTICE_FLASH)
+	session.Save(req, res)
+	http.Redirect(res, req, path, http.StatusSeeOther)
+}
+
+// takeNotice returns the notice left by memberNotice, if there is one.
+func takeNotice(res http.ResponseWriter, req *http.Request) interface{} {
+	session, _ := STORE.Get(req, USER_SESSION)
+	flashes := session.Flashes(NOTICE_FLASH)
+	if len(flashes) == 0 {
+		return nil
+	}
+	session.Save(req, res)
+	return flashes[0]
+}
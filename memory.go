@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryCollection is a tiny stand-in for a Mongo collection. Documents are
+// kept as bson.M so that bson tags, projections and updates behave the same
+// way they do against a real database.
+type memoryCollection struct {
+	mu   sync.RWMutex
+	docs []bson.M
+}
+
+func newMemoryCollection() *memoryCollection {
+	return &memoryCollection{}
+}
+
+func (m *memoryCollection) findOne(query bson.M, result interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	for _, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return err
+		}
+		if matched {
+			return fromDocument(doc, result)
+		}
+	}
+	return errNotFound
+}
+
+// findAll decodes every matching document into result, which must be a
+// pointer to a slice. Only fields (plus _id) are kept when fields is set.
+func (m *memoryCollection) findAll(query bson.M, fields []string, result interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return errors.New("memory: result must be a pointer to a slice")
+	}
+	slice = slice.Elem()
+	items := reflect.MakeSlice(slice.Type(), 0, len(m.docs))
+	for _, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+		item := reflect.New(slice.Type().Elem())
+		if err := fromDocument(selectFields(doc, fields), item.Interface()); err != nil {
+			return err
+		}
+		items = reflect.Append(items, item.Elem())
+	}
+	slice.Set(items)
+	return nil
+}
+
+func (m *memoryCollection) insert(value interface{}) error {
+	return m.insertUnique(value)
+}
+
+// insertUnique is insert, refusing with a duplicateError a document that
+// repeats the value of any of fields, the way a unique index would. Empty
+// strings may repeat, as under the partial index on email.
+func (m *memoryCollection) insertUnique(value interface{}, fields ...string) error {
+	doc, err := toDocument(value)
+	if err != nil {
+		return err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.docs {
+		for _, field := range fields {
+			if doc[field] == "" {
+				continue
+			}
+			if reflect.DeepEqual(existing[field], doc[field]) {
+				return &duplicateError{field}
+			}
+		}
+	}
+	m.docs = append(m.docs, doc)
+	return nil
+}
+
+// updateEach sets the fields fn returns on each document, skipping those
+// it returns nil for, and counts the documents changed. With dryRun
+// nothing is written.
+func (m *memoryCollection) updateEach(fn func(doc bson.M) bson.M, dryRun bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := 0
+	for _, doc := range m.docs {
+		fields, err := toDocument(fn(doc))
+		if err != nil {
+			return changed, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+		for name, value := range fields {
+			doc[name] = value
+		}
+	}
+	return changed, nil
+}
+
+// update applies fields as a $set to the first matching document.
+func (m *memoryCollection) update(query bson.M, fields bson.M) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	fields, err = toDocument(fields)
+	if err != nil {
+		return err
+	}
+	for _, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return err
+		}
+		if matched {
+			for key, value := range fields {
+				doc[key] = value
+			}
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// remove deletes the first matching document.
+func (m *memoryCollection) remove(query bson.M) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	for i, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return err
+		}
+		if matched {
+			m.docs = append(m.docs[:i], m.docs[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// unset removes fields from the first matching document.
+func (m *memoryCollection) unset(query bson.M, fields ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	for _, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return err
+		}
+		if matched {
+			for _, field := range fields {
+				delete(doc, field)
+			}
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// removeAll deletes every matching document and reports how many there were.
+func (m *memoryCollection) removeAll(query bson.M) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query, err := toDocument(query)
+	if err != nil {
+		return 0, err
+	}
+	// a query can fail part way, so keep the documents aside until it is done
+	kept := make([]bson.M, 0, len(m.docs))
+	for _, doc := range m.docs {
+		matched, err := matchDocument(doc, query)
+		if err != nil {
+			return 0, err
+		}
+		if !matched {
+			kept = append(kept, doc)
+		}
+	}
+	removed := len(m.docs) - len(kept)
+	m.docs = kept
+	return removed, nil
+}
+
+func matchDocument(doc bson.M, query bson.M) (bool, error) {
+	for key, want := range query {
+		matched, err := matchValue(doc[key], want)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchValue compares a field against a query value, which may be an
+// operator document. Only the operators the stores use are supported; any
+// other is an error, as it would be from a server that did not know it.
+func matchValue(have interface{}, want interface{}) (bool, error) {
+	operators, ok := want.(bson.M)
+	if !ok {
+		return reflect.DeepEqual(have, want), nil
+	}
+	for operator, operand := range operators {
+		switch operator {
+		case "$in":
+			candidates, ok := operand.([]interface{})
+			if !ok {
+				return false, errors.New("memory: $in needs an array")
+			}
+			found := false
+			for _, candidate := range candidates {
+				if reflect.DeepEqual(have, candidate) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false, nil
+			}
+		case "$ne":
+			if reflect.DeepEqual(have, operand) {
+				return false, nil
+			}
+		default:
+			return false, errors.New("memory: unsupported query operator " + operator)
+		}
+	}
+	return true, nil
+}
+
+func selectFields(doc bson.M, fields []string) bson.M {
+	if len(fields) == 0 {
+		return doc
+	}
+	selected := bson.M{"_id": doc["_id"]}
+	for _, field := range fields {
+		if value, ok := doc[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+// toDocument round-trips value through bson so it is stored exactly as mgo
+// would send it to the server.
+func toDocument(value interface{}) (bson.M, error) {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+func fromDocument(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// useMemoryStores points every store at a fresh in-memory one, with blobs
+// in a temporary directory, as -memory does.
+func useMemoryStores(t *testing.T) {
+	t.Helper()
+	if err := openStores(Config{BlobStore: BLOB_STORE_FILESYSTEM, BlobDir: t.TempDir()}, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryCollectionQueries(t *testing.T) {
+	docs := newMemoryCollection()
+	for _, name := range []string{"ann", "bob", "cy"} {
+		if err := docs.insert(bson.M{"name": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query   bson.M
+		count   int
+		wantErr bool
+	}{
+		{bson.M{}, 3, false},
+		{bson.M{"name": "bob"}, 1, false},
+		{bson.M{"name": bson.M{"$in": []interface{}{"ann", "cy", "dee"}}}, 2, false},
+		{bson.M{"name": bson.M{"$ne": "ann"}}, 2, false},
+		{bson.M{"name": bson.M{"$gt": "ann"}}, 0, true},
+		{bson.M{"name": bson.M{"$in": "ann"}}, 0, true},
+	}
+	for _, test := range tests {
+		var found []bson.M
+		err := docs.findAll(test.query, nil, &found)
+		if (err != nil) != test.wantErr {
+			t.Errorf("findAll(%v) error = %v, want error %v", test.query, err, test.wantErr)
+			continue
+		}
+		if len(found) != test.count {
+			t.Errorf("findAll(%v) found %d, want %d", test.query, len(found), test.count)
+		}
+	}
+}
+
+func TestMemoryCollectionUnsupportedOperator(t *testing.T) {
+	docs := newMemoryCollection()
+	if err := docs.insert(bson.M{"name": "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	query := bson.M{"name": bson.M{"$regex": "^a"}}
+	var doc bson.M
+	if err := docs.findOne(query, &doc); err == nil {
+		t.Error("findOne: want an error")
+	}
+	if err := docs.update(query, bson.M{"name": "bo"}); err == nil {
+		t.Error("update: want an error")
+	}
+	if err := docs.unset(query, "name"); err == nil {
+		t.Error("unset: want an error")
+	}
+	if err := docs.remove(query); err == nil {
+		t.Error("remove: want an error")
+	}
+	if _, err := docs.removeAll(query); err == nil {
+		t.Error("removeAll: want an error")
+	}
+	if err := docs.findOne(bson.M{"name": "ann"}, &doc); err != nil {
+		t.Errorf("document changed by a failed query: %v", err)
+	}
+}
+
+func TestMemoryCollectionInsertUnique(t *testing.T) {
+	docs := newMemoryCollection()
+	tests := []struct {
+		doc     bson.M
+		wantErr bool
+	}{
+		{bson.M{"username": "ann", "email": "ann@example.com"}, false},
+		{bson.M{"username": "bob", "email": ""}, false},
+		{bson.M{"username": "cy", "email": ""}, false},
+		{bson.M{"username": "ann", "email": "other@example.com"}, true},
+		{bson.M{"username": "dee", "email": "ann@example.com"}, true},
+	}
+	for _, test := range tests {
+		err := docs.insertUnique(test.doc, "username", "email")
+		if (err != nil) != test.wantErr {
+			t.Errorf("insertUnique(%v) error = %v, want error %v", test.doc, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Schema migrations
+//
+// Changes to the shape of stored documents are made by the migrations in
+// MIGRATIONS, applied in version order. Each applied version is recorded
+// in the migration collection with its checksum; the server applies any
+// pending ones at startup, and `migrate` applies, undoes or previews them
+// from the shell. Only one process migrates at a time: the others wait on
+// a lock held in the same collection. Its holder renews it every
+// MIGRATION_LOCK_RENEW and stops before the next write once it cannot, so
+// the lock lapses after MIGRATION_LOCK_TTL if its holder dies. Long
+// migrations check the lock again before every MIGRATION_BATCH_SIZE
+// documents they write.
+//
+// To add a migration, append it to MIGRATIONS with the next version and
+// Revision 1. Never edit a migration that has been released; a fix goes in
+// a new one. Any change to what a migration does, before release too,
+// bumps its Revision. The checksum covers the version, name, description
+// and revision, and the server refuses to start when an applied migration
+// no longer matches, or one it does not know about was applied by a newer
+// build.
+var migrationStore MigrationStore
+
+var DB_COLLECTION_MIGRATION string
+
+var MIGRATION_LOCK_ID = "lock"
+var MIGRATION_LOCK_TTL = 15 * time.Minute
+var MIGRATION_LOCK_RENEW = time.Minute
+var MIGRATION_LOCK_POLL = 2 * time.Second
+var MIGRATION_BATCH_SIZE = 100
+
+var errMigrationLocked = errors.New("another process is running migrations")
+var errMigrationLockLost = errors.New("the migration lock expired before the migrations finished")
+
+type Migration struct {
+	Version     int
+	Name        string
+	Description string
+	// Revision is bumped whenever Up or Down changes.
+	Revision int
+	// Up and Down return how many documents they changed, or would change
+	// with dryRun. They call held before each batch of writes and stop on
+	// its error. Down is nil for migrations that cannot be undone.
+	Up   func(held func() error, dryRun bool) (int, error)
+	Down func(held func() error, dryRun bool) (int, error)
+}
+
+var MIGRATIONS = []Migration{
+	{
+		Version:     1,
+		Name:        "typed-person-fields",
+		Description: "Store member dob as a date and amount as a Decimal128, and add created and updated times.",
+		Revision:    1,
+		Up: func(held func() error, dryRun bool) (int, error) {
+			return migrationStore.Rewrite(DB_COLLECTION_PERSON, legacyPersonFields, held, dryRun)
+		},
+		Down: func(held func() error, dryRun bool) (int, error) {
+			return migrationStore.Rewrite(DB_COLLECTION_PERSON, untypedPersonFields, held, dryRun)
+		},
+	},
+	{
+		Version:     2,
+		Name:        "legacy-documents",
+		Description: "Move the single document held on member records into the document collection.",
+		Revision:    1,
+		Up:          migrateLegacyDocuments,
+	},
+	{
+		Version:     3,
+		Name:        "country-codes",
+		Description: "Store member country and nationality as ISO 3166-1 alpha-2 codes, logging values that name no country.",
+		Revision:    1,
+		Up: func(held func() error, dryRun bool) (int, error) {
+			return migrationStore.Rewrite(DB_COLLECTION_PERSON, codedCountryFields, held, dryRun)
+		},
+	},
+	{
+		Version:     4,
+		Name:        "lowercase-emails",
+		Description: "Store member emails lowercased, logging members whose emails differ only in case.",
+		Revision:    1,
+		Up:          lowercaseEmails,
+	},
+}
+
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(m.Version) + "\n" + m.Name + "\n" + m.Description + "\n" + strconv.Itoa(m.Revision)))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationRecord is kept for each applied migration.
+type MigrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	Checksum  string    `bson:"checksum"`
+	Appliedat time.Time `bson:"appliedat"`
+	Appliedby string    `bson:"appliedby"`
+}
+
+type MigrationLock struct {
+	ID      string    `bson:"_id"`
+	Owner   string    `bson:"owner"`
+	Expires time.Time `bson:"expires"`
+}
+
+type MigrationStore interface {
+	// Applied lists the applied migrations by version.
+	Applied() ([]MigrationRecord, error)
+	Record(record MigrationRecord) error
+	Forget(version int) error
+	// Lock takes the migration lock for owner, failing with
+	// errMigrationLocked while someone else holds it.
+	Lock(owner string, ttl time.Duration) error
+	// Renew extends owner's lock to ttl from now, failing with
+	// errMigrationLockLost once owner no longer holds it.
+	Renew(owner string, ttl time.Duration) error
+	// Unlock releases owner's lock, or any lock when owner is empty.
+	Unlock(owner string) error
+	// Rewrite sets the fields fn returns on each document in collection,
+	// skipping those it returns nil for, and counts the documents changed.
+	// It calls held before each batch of writes.
+	Rewrite(collection string, fn func(doc bson.M) bson.M, held func() error, dryRun bool) (int, error)
+}
+
+// MigrationStatus pairs a migration with its record. State is "applied",
+// "pending", "changed" when the checksums differ, or "unknown" for a
+// record with no migration in this build.
+type MigrationStatus struct {
+	Migration Migration
+	Record    *MigrationRecord
+	State     string
+}
+
+func migrationStatuses() ([]MigrationStatus, error) {
+	records, err := migrationStore.Applied()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]*MigrationRecord{}
+	for i := range records {
+		applied[records[i].Version] = &records[i]
+	}
+	statuses := []MigrationStatus{}
+	for _, migration := range MIGRATIONS {
+		status := MigrationStatus{Migration: migration, Record: applied[migration.Version], State: "pending"}
+		if status.Record != nil {
+			status.State = "applied"
+			if status.Record.Checksum != migration.Checksum() {
+				status.State = "changed"
+			}
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range applied {
+		statuses = append(statuses, MigrationStatus{Migration: Migration{Version: record.Version, Name: record.Name}, Record: record, State: "unknown"})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Migration.Version < statuses[j].Migration.Version })
+	return statuses, nil
+}
+
+// checkMigrationStatuses refuses to go on from a database this build does
+// not fully understand.
+func checkMigrationStatuses(statuses []MigrationStatus) error {
+	for _, status := range statuses {
+		switch status.State {
+		case "changed":
+			return fmt.Errorf("migration %d %s was changed after it was applied", status.Migration.Version, status.Migration.Name)
+		case "unknown":
+			return fmt.Errorf("migration %d %s was applied by a newer build", status.Migration.Version, status.Migration.Name)
+		}
+	}
+	return nil
+}
+
+func migrationOwner() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// withMigrationLock runs fn holding the migration lock, which is renewed
+// in the background meanwhile. fn calls held before each write; it renews
+// the lock and fails once the lock was lost.
+func withMigrationLock(fn func(held func() error) error) error {
+	owner := migrationOwner()
+	if err := migrationStore.Lock(owner, MIGRATION_LOCK_TTL); err != nil {
+		return err
+	}
+	defer func() {
+		if err := migrationStore.Unlock(owner); err != nil {
+			log.Print("Error releasing the migration lock: ", err)
+		}
+	}()
+	var mu sync.Mutex
+	var lost error
+	held := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if lost == nil {
+			if err := migrationStore.Renew(owner, MIGRATION_LOCK_TTL); err == errMigrationLockLost {
+				lost = err
+			} else if err != nil {
+				log.Print("Error renewing the migration lock: ", err)
+			}
+		}
+		return lost
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(MIGRATION_LOCK_RENEW)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				held()
+			}
+		}
+	}()
+	return fn(held)
+}
+
+// notLocked stands in for held when nothing is written.
+func notLocked() error {
+	return nil
+}
+
+// migrateUp applies the pending migrations up to and including version to,
+// or all of them when to is 0, calling report after each.
+func migrateUp(to int, dryRun bool, report func(migration Migration, changed int)) error {
+	run := func(held func() error) error {
+		statuses, err := migrationStatuses()
+		if err != nil {
+			return err
+		}
+		if err := checkMigrationStatuses(statuses); err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			migration := status.Migration
+			if status.State != "pending" || (to > 0 && migration.Version > to) {
+				continue
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			changed, err := migration.Up(held, dryRun)
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %v", migration.Version, migration.Name, err)
+			}
+			if !dryRun {
+				record := MigrationRecord{
+					Version:   migration.Version,
+					Name:      migration.Name,
+					Checksum:  migration.Checksum(),
+					Appliedat: time.Now(),
+					Appliedby: migrationOwner()}
+				if err := held(); err != nil {
+					return err
+				}
+				if err := migrationStore.Record(record); err != nil {
+					return err
+				}
+			}
+			report(migration, changed)
+		}
+		return nil
+	}
+	if dryRun {
+		return run(notLocked)
+	}
+	return withMigrationLock(run)
+}
+
+// migrateDown undoes the applied migrations above version to, newest first,
+// or only the newest when to is negative.
+func migrateDown(to int, dryRun bool, report func(migration Migration, changed int)) error {
+	run := func(held func() error) error {
+		statuses, err := migrationStatuses()
+		if err != nil {
+			return err
+		}
+		if err := checkMigrationStatuses(statuses); err != nil {
+			return err
+		}
+		for i := len(statuses) - 1; i >= 0; i-- {
+			migration := statuses[i].Migration
+			if statuses[i].State != "applied" || migration.Version <= to {
+				continue
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %d %s cannot be undone", migration.Version, migration.Name)
+			}
+			if err := held(); err != nil {
+				return err
+			}
+			changed, err := migration.Down(held, dryRun)
+			if err != nil {
+				return fmt.Errorf("undoing migration %d %s: %v", migration.Version, migration.Name, err)
+			}
+			if !dryRun {
+				if err := held(); err != nil {
+					return err
+				}
+				if err := migrationStore.Forget(migration.Version); err != nil {
+					return err
+				}
+			}
+			report(migration, changed)
+			if to < 0 {
+				break
+			}
+		}
+		return nil
+	}
+	if dryRun {
+		return run(notLocked)
+	}
+	return withMigrationLock(run)
+}
+
+// migrateOnStartup applies pending migrations before the server reads
+// anything, waiting while another instance does it.
+func migrateOnStartup() error {
+	for {
+		err := migrateUp(0, false, func(migration Migration, changed int) {
+			log.Printf("Applied migration %d %s: %d documents changed", migration.Version, migration.Name, changed)
+		})
+		if err != errMigrationLocked {
+			return err
+		}
+		log.Print("Waiting for another instance to finish migrating")
+		time.Sleep(MIGRATION_LOCK_POLL)
+	}
+}
+
+// migrateCommand shows, applies and undoes migrations from the shell.
+func migrateCommand(args []string) error {
+	usage := errors.New("usage: migrate status|up|down|unlock [-config file] [-to version] [-dry-run]")
+	if len(args) == 0 {
+		return usage
+	}
+	flags, configFile := commandFlags("migrate " + args[0])
+	to := flags.Int("to", -1, "up: last version to apply (default all); down: version to go back to (default undo only the newest)")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+	flags.Parse(args[1:])
+
+	if args[0] != "status" && args[0] != "up" && args[0] != "down" && args[0] != "unlock" {
+		return usage
+	}
+	if err := openCommandStores(*configFile); err != nil {
+		return err
+	}
+	defer dbConnection.Close()
+
+	verb := "applied"
+	if args[0] == "down" {
+		verb = "undid"
+	}
+	if *dryRun {
+		verb = "would have " + verb
+	}
+	report := func(migration Migration, changed int) {
+		fmt.Printf("%s %d %s: %d documents changed\n", verb, migration.Version, migration.Name, changed)
+	}
+	switch args[0] {
+	case "up":
+		if *to < 0 {
+			*to = 0
+		}
+		return migrateUp(*to, *dryRun, report)
+	case "down":
+		return migrateDown(*to, *dryRun, report)
+	case "unlock":
+		return migrationStore.Unlock("")
+	}
+
+	statuses, err := migrationStatuses()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED\tBY")
+	for _, status := range statuses {
+		applied, by := "", ""
+		if status.Record != nil {
+			applied, by = status.Record.Appliedat.UTC().Format(time.RFC3339), status.Record.Appliedby
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", status.Migration.Version, status.Migration.Name, status.State, applied, by)
+	}
+	return w.Flush()
+}
+
+// Mongo implementation
+
+type mgoMigrationStore struct{ mgoCollection }
+
+func newMgoMigrationStore(session *mgo.Session) *mgoMigrationStore {
+	return &mgoMigrationStore{mgoCollection{session, DB_COLLECTION_MIGRATION}}
+}
+
+func (s *mgoMigrationStore) Applied() (records []MigrationRecord, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"_id": bson.M{"$ne": MIGRATION_LOCK_ID}}).Sort("_id").All(&records)
+	})
+	return
+}
+
+func (s *mgoMigrationStore) Record(record MigrationRecord) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(record)
+	})
+}
+
+func (s *mgoMigrationStore) Forget(version int) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.RemoveId(version)
+	})
+}
+
+// Lock upserts the lock only if it has lapsed; while it is held the upsert
+// tries to insert a second document with the lock's _id and fails.
+func (s *mgoMigrationStore) Lock(owner string, ttl time.Duration) error {
+	now := time.Now()
+	return s.with(func(c *mgo.Collection) error {
+		_, err := c.Upsert(bson.M{"_id": MIGRATION_LOCK_ID, "expires": bson.M{"$lt": now}},
+			MigrationLock{MIGRATION_LOCK_ID, owner, now.Add(ttl)})
+		if mgo.IsDup(err) {
+			return errMigrationLocked
+		}
+		return err
+	})
+}
+
+func (s *mgoMigrationStore) Renew(owner string, ttl time.Duration) error {
+	now := time.Now()
+	return s.with(func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"_id": MIGRATION_LOCK_ID, "owner": owner, "expires": bson.M{"$gt": now}},
+			bson.M{"$set": bson.M{"expires": now.Add(ttl)}})
+		if err == mgo.ErrNotFound {
+			return errMigrationLockLost
+		}
+		return err
+	})
+}
+
+func (s *mgoMigrationStore) Unlock(owner string) error {
+	query := bson.M{"_id": MIGRATION_LOCK_ID}
+	if owner != "" {
+		query["owner"] = owner
+	}
+	return s.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(query)
+		return err
+	})
+}
+
+func (s *mgoMigrationStore) Rewrite(collection string, fn func(doc bson.M) bson.M, held func() error, dryRun bool) (changed int, err error) {
+	err = mgoCollection{s.session, collection}.with(func(c *mgo.Collection) error {
+		iter := c.Find(nil).Iter()
+		var doc bson.M
+		for iter.Next(&doc) {
+			if fields := fn(doc); fields != nil {
+				if changed%MIGRATION_BATCH_SIZE == 0 {
+					if err := held(); err != nil {
+						iter.Close()
+						return err
+					}
+				}
+				changed++
+				if !dryRun {
+					if err := c.UpdateId(doc["_id"], bson.M{"$set": fields}); err != nil {
+						iter.Close()
+						return err
+					}
+				}
+			}
+			doc = nil
+		}
+		return iter.Close()
+	})
+	return
+}
+
+// In-memory implementation
+
+type memoryMigrationStore struct {
+	docs        *memoryCollection
+	collections map[string]*memoryCollection
+
+	mu   sync.Mutex
+	lock MigrationLock
+}
+
+// newMemoryMigrationStore migrates the given collections, by name.
+func newMemoryMigrationStore(collections map[string]*memoryCollection) *memoryMigrationStore {
+	return &memoryMigrationStore{docs: newMemoryCollection(), collections: collections}
+}
+
+func (s *memoryMigrationStore) Applied() (records []MigrationRecord, err error) {
+	err = s.docs.findAll(bson.M{}, nil, &records)
+	sort.Slice(records, func(i, j int) bool { return records[i].Version < records[j].Version })
+	return
+}
+
+func (s *memoryMigrationStore) Record(record MigrationRecord) error {
+	return s.docs.insert(record)
+}
+
+func (s *memoryMigrationStore) Forget(version int) error {
+	return s.docs.remove(bson.M{"_id": version})
+}
+
+func (s *memoryMigrationStore) Lock(owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.lock.Expires.After(now) {
+		return errMigrationLocked
+	}
+	s.lock = MigrationLock{MIGRATION_LOCK_ID, owner, now.Add(ttl)}
+	return nil
+}
+
+func (s *memoryMigrationStore) Renew(owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.lock.Owner != owner || !s.lock.Expires.After(now) {
+		return errMigrationLockLost
+	}
+	s.lock.Expires = now.Add(ttl)
+	return nil
+}
+
+func (s *memoryMigrationStore) Unlock(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner == "" || s.lock.Owner == owner {
+		s.lock = MigrationLock{}
+	}
+	return nil
+}
+
+// Rewrite changes the whole collection at once, as one batch.
+func (s *memoryMigrationStore) Rewrite(collection string, fn func(doc bson.M) bson.M, held func() error, dryRun bool) (int, error) {
+	docs, ok := s.collections[collection]
+	if !ok {
+		return 0, fmt.Errorf("memory: no collection %q", collection)
+	}
+	if err := held(); err != nil {
+		return 0, err
+	}
+	return docs.updateEach(fn, dryRun)
+}
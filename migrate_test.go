@@ -0,0 +1,201 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// setField is a migration step setting field to value on every member that
+// has another value.
+func setField(field string, value interface{}) func(held func() error, dryRun bool) (int, error) {
+	return func(held func() error, dryRun bool) (int, error) {
+		return migrationStore.Rewrite(DB_COLLECTION_PERSON, func(doc bson.M) bson.M {
+			if doc[field] == value {
+				return nil
+			}
+			return bson.M{field: value}
+		}, held, dryRun)
+	}
+}
+
+// useTestMigrations replaces MIGRATIONS for one test, with two members to
+// migrate in fresh in-memory stores.
+func useTestMigrations(t *testing.T, migrations []Migration) {
+	t.Helper()
+	useMemoryStores(t)
+	saved := MIGRATIONS
+	MIGRATIONS = migrations
+	t.Cleanup(func() { MIGRATIONS = saved })
+	for _, username := range []string{"ann", "bob"} {
+		if err := personStore.Insert(&Person{Username: username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "flag", Revision: 1, Up: setField("flag", true), Down: setField("flag", false)},
+	{Version: 2, Name: "tag", Revision: 1, Up: setField("tag", "two"), Down: setField("tag", "")},
+	{Version: 3, Name: "one-way", Revision: 1, Up: setField("three", true)},
+}
+
+// memberField returns field of every member, by username.
+func memberField(t *testing.T, field string) map[string]interface{} {
+	t.Helper()
+	var docs []bson.M
+	if err := personStore.(*memoryPersonStore).docs.findAll(bson.M{}, nil, &docs); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{}
+	for _, doc := range docs {
+		values[doc["username"].(string)] = doc[field]
+	}
+	return values
+}
+
+func appliedVersions(t *testing.T) []int {
+	t.Helper()
+	records, err := migrationStore.Applied()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := []int{}
+	for _, record := range records {
+		versions = append(versions, record.Version)
+	}
+	return versions
+}
+
+func sameVersions(a []int, b ...int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	useTestMigrations(t, testMigrations)
+	var reported []string
+	report := func(migration Migration, changed int) {
+		reported = append(reported, migration.Name+":"+strconv.Itoa(changed))
+	}
+
+	if err := migrateUp(2, false, report); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(reported, " "); got != "flag:2 tag:2" {
+		t.Errorf("up to 2 reported %q", got)
+	}
+	if versions := appliedVersions(t); !sameVersions(versions, 1, 2) {
+		t.Errorf("applied after up to 2 = %v, want 1 2", versions)
+	}
+	if tags := memberField(t, "tag"); tags["ann"] != "two" || tags["bob"] != "two" {
+		t.Errorf("tags after up = %v", tags)
+	}
+
+	reported = nil
+	if err := migrateDown(-1, false, report); err != nil {
+		t.Fatal(err)
+	}
+	if versions := appliedVersions(t); !sameVersions(versions, 1) || strings.Join(reported, " ") != "tag:2" {
+		t.Errorf("down once: applied %v, reported %v, want 1 left after undoing tag", versions, reported)
+	}
+	if tags := memberField(t, "tag"); tags["ann"] != "" {
+		t.Errorf("tags after down = %v", tags)
+	}
+
+	if err := migrateUp(0, false, report); err != nil {
+		t.Fatal(err)
+	}
+	if versions := appliedVersions(t); !sameVersions(versions, 1, 2, 3) {
+		t.Errorf("applied after up = %v, want 1 2 3", versions)
+	}
+	err := migrateDown(0, false, report)
+	if err == nil || !strings.Contains(err.Error(), "cannot be undone") {
+		t.Errorf("undoing a one-way migration: error = %v", err)
+	}
+	if versions := appliedVersions(t); !sameVersions(versions, 1, 2, 3) {
+		t.Errorf("applied after a refused down = %v, want 1 2 3", versions)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	useTestMigrations(t, testMigrations)
+	changed := map[string]int{}
+	report := func(migration Migration, n int) { changed[migration.Name] = n }
+
+	if err := migrateUp(0, true, report); err != nil {
+		t.Fatal(err)
+	}
+	if changed["flag"] != 2 || changed["tag"] != 2 || changed["one-way"] != 2 {
+		t.Errorf("dry run reported %v, want 2 members each", changed)
+	}
+	if versions := appliedVersions(t); len(versions) != 0 {
+		t.Errorf("dry run recorded %v", versions)
+	}
+	if flags := memberField(t, "flag"); flags["ann"] != nil {
+		t.Errorf("dry run wrote flags %v", flags)
+	}
+}
+
+func TestMigrateChangedChecksum(t *testing.T) {
+	useTestMigrations(t, testMigrations)
+	if err := migrateUp(1, false, func(Migration, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	MIGRATIONS[0].Revision = 2
+	defer func() { MIGRATIONS[0].Revision = 1 }()
+	if err := migrateUp(0, false, func(Migration, int) {}); err == nil || !strings.Contains(err.Error(), "changed after it was applied") {
+		t.Errorf("up after a migration changed: error = %v", err)
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	useTestMigrations(t, testMigrations)
+	if err := migrationStore.Lock("elsewhere", MIGRATION_LOCK_TTL); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(0, false, func(Migration, int) {}); err != errMigrationLocked {
+		t.Errorf("up while locked: error = %v, want errMigrationLocked", err)
+	}
+	if err := migrateUp(0, true, func(Migration, int) {}); err != nil {
+		t.Errorf("dry run while locked: %v", err)
+	}
+	if err := migrationStore.Unlock("elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(0, false, func(Migration, int) {}); err != nil {
+		t.Errorf("up once unlocked: %v", err)
+	}
+}
+
+func TestMigrateLockLost(t *testing.T) {
+	// the lock lapses while the second migration runs, before its write
+	lapse := func(held func() error, dryRun bool) (int, error) {
+		if err := migrationStore.Unlock(""); err != nil {
+			return 0, err
+		}
+		return setField("tag", "two")(held, dryRun)
+	}
+	useTestMigrations(t, []Migration{
+		{Version: 1, Name: "flag", Revision: 1, Up: setField("flag", true)},
+		{Version: 2, Name: "lapse", Revision: 1, Up: lapse},
+	})
+	if err := migrateUp(0, false, func(Migration, int) {}); err == nil || !strings.Contains(err.Error(), errMigrationLockLost.Error()) {
+		t.Errorf("up losing the lock: error = %v, want errMigrationLockLost", err)
+	}
+	if tags := memberField(t, "tag"); tags["ann"] != nil || tags["bob"] != nil {
+		t.Errorf("written after the lock was lost: %v", tags)
+	}
+	if versions := appliedVersions(t); !sameVersions(versions, 1) {
+		t.Errorf("applied = %v, want only 1", versions)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Typed member fields
+//
+// Members are identified in URLs by their ObjectId, dates of birth are
+// dates and payments are exact decimals. Records written before that kept
+// strings; the typed-person-fields migration rewrites them in place.
+type Gender string
+
+var GENDER_MALE = Gender("male")
+var GENDER_FEMALE = Gender("female")
+
+var GENDERS = []Gender{GENDER_MALE, GENDER_FEMALE}
+
+func (g Gender) valid() bool {
+	for _, gender := range GENDERS {
+		if g == gender {
+			return true
+		}
+	}
+	return false
+}
+
+// Money is an amount of money, kept as a BSON Decimal128 so it is stored
+// and compared exactly.
+type Money bson.Decimal128
+
+var MONEY_PATTERN = regexp.MustCompile(`^[0-9]{1,15}(\.[0-9]{1,2})?$`)
+
+var errInvalidMoney = errors.New("the amount must be a number with at most two decimal places")
+
+// parseMoney reads a non-negative amount with up to two decimal places.
+func parseMoney(value string) (Money, error) {
+	if !MONEY_PATTERN.MatchString(value) {
+		return Money{}, errInvalidMoney
+	}
+	amount, err := bson.ParseDecimal128(value)
+	if err != nil {
+		return Money{}, errInvalidMoney
+	}
+	return Money(amount), nil
+}
+
+// ZERO_MONEY is what the zero value of Money is stored and shown as.
+var ZERO_MONEY, _ = parseMoney("0")
+
+func (m Money) String() string {
+	if m == (Money{}) {
+		m = ZERO_MONEY
+	}
+	return bson.Decimal128(m).String()
+}
+
+func (m Money) GetBSON() (interface{}, error) {
+	if m == (Money{}) {
+		m = ZERO_MONEY
+	}
+	return bson.Decimal128(m), nil
+}
+
+func (m *Money) SetBSON(raw bson.Raw) error {
+	var amount bson.Decimal128
+	if err := raw.Unmarshal(&amount); err != nil {
+		return err
+	}
+	*m = Money(amount)
+	return nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// dateText shows a date as YYYY-MM-DD, or nothing if it is not set.
+func dateText(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format(DOB_LAYOUT)
+}
+
+// legacyPersonFields returns the $set that gives an older person document
+// typed fields, or nil if it has them already. The date of birth was free
+// text; one that cannot be read is dropped, and logged so it can be asked
+// for again.
+func legacyPersonFields(doc bson.M) bson.M {
+	fields := bson.M{}
+	if dob, ok := doc["dob"].(string); ok {
+		if date, err := parseDob(dob); err == nil {
+			fields["dob"] = date
+		} else {
+			log.Printf("Member %v has an unreadable date of birth %q; it has been cleared", doc["username"], dob)
+			fields["dob"] = time.Time{}
+		}
+	}
+	switch amount := doc["amount"].(type) {
+	case bson.Decimal128:
+	case string:
+		money, err := parseMoney(amount)
+		if err != nil {
+			log.Printf("Member %v has an unreadable amount %q; it has been set to 0", doc["username"], amount)
+		}
+		fields["amount"] = money
+	default:
+		fields["amount"] = Money{}
+	}
+	if _, ok := doc["created"].(time.Time); !ok {
+		created := time.Now()
+		if id, ok := doc["_id"].(bson.ObjectId); ok {
+			created = id.Time()
+		}
+		fields["created"] = created
+		if _, ok := doc["updated"].(time.Time); !ok {
+			fields["updated"] = created
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// untypedPersonFields undoes legacyPersonFields for a build that expects
+// strings again. Created and updated are left, as older builds ignore them.
+func untypedPersonFields(doc bson.M) bson.M {
+	fields := bson.M{}
+	if dob, ok := doc["dob"].(time.Time); ok {
+		fields["dob"] = dateText(dob)
+	}
+	if amount, ok := doc["amount"].(bson.Decimal128); ok {
+		fields["amount"] = Money(amount).String()
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// codedCountryFields returns the $set that stores a member's free text
+// country and nationality as codes, or nil if there is nothing to change.
+// A value that names no country is logged and left for an admin to fix.
+func codedCountryFields(doc bson.M) bson.M {
+	fields := bson.M{}
+	for _, field := range []string{"country", "nationality"} {
+		value, _ := doc[field].(string)
+		if value == "" {
+			continue
+		}
+		country, ok := countryFromText(value)
+		if !ok {
+			log.Printf("Member %v has a %s %q that is no known country; it has been left as it is", doc["username"], field, value)
+			continue
+		}
+		if country.Code != value {
+			fields[field] = country.Code
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// lowercaseEmails stores member emails lowercased, as normalizeEmail does
+// for new ones. Members whose emails differ only in case would collide
+// under the unique email index; they are logged and left for an admin to
+// tell apart.
+func lowercaseEmails(held func() error, dryRun bool) (int, error) {
+	owners := map[string][]string{}
+	_, err := migrationStore.Rewrite(DB_COLLECTION_PERSON, func(doc bson.M) bson.M {
+		if email, _ := doc["email"].(string); email != "" {
+			username, _ := doc["username"].(string)
+			owners[strings.ToLower(email)] = append(owners[strings.ToLower(email)], username)
+		}
+		return nil
+	}, held, true)
+	if err != nil {
+		return 0, err
+	}
+	for email, usernames := range owners {
+		if len(usernames) > 1 {
+			sort.Strings(usernames)
+			log.Printf("Members %s share the email %q once it is lowercased; their emails have been left as they are", strings.Join(usernames, ", "), email)
+		}
+	}
+	return migrationStore.Rewrite(DB_COLLECTION_PERSON, func(doc bson.M) bson.M {
+		email, _ := doc["email"].(string)
+		lower := strings.ToLower(email)
+		if lower == email || len(owners[lower]) > 1 {
+			return nil
+		}
+		return bson.M{"email": lower}
+	}, held, dryRun)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Passport machine readable zone
+//
+// A TD3 (passport) MRZ is two lines of 44 characters, laid out by ICAO Doc
+// 9303 part 4. Members may paste theirs when registering and admins can
+// enter it while reviewing; it is kept as typed (once normalized) in
+// Person.Mrz and parsed again whenever it is shown, so the review page
+// always compares it with the member's current details.
+var MRZ_LINE_LENGTH = 44
+
+// Codes 9303 uses that are not ISO 3166-1 countries.
+var MRZ_COUNTRY_CODES = map[string]string{
+	"D":   "DE",
+	"GBD": "GB",
+	"GBN": "GB",
+	"GBO": "GB",
+	"GBP": "GB",
+	"GBS": "GB",
+}
+
+var errMrzFormat = errors.New("the MRZ must be two lines of 44 characters, the first starting with P")
+
+type Mrz struct {
+	DocumentType   string
+	IssuingState   string
+	Surname        string
+	GivenNames     string
+	NameTruncated  bool
+	Number         string
+	Nationality    string
+	Dob            time.Time
+	Sex            string
+	Expiry         time.Time
+	PersonalNumber string
+}
+
+// MrzMismatch is a field where the MRZ and the member's details differ.
+type MrzMismatch struct {
+	Field  string
+	Mrz    string
+	Member string
+}
+
+// MrzReview is what the review page shows about a member's MRZ: either
+// Error, or the parsed Mrz and how it compares.
+type MrzReview struct {
+	Text       string
+	Error      string
+	Mrz        Mrz
+	Mismatches []MrzMismatch
+}
+
+// normalizeMrz uppercases text and puts it into two lines, dropping the
+// spaces and blank lines pasting tends to add. A single 88 character line
+// is split in two.
+func normalizeMrz(text string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ToUpper(text), "\n") {
+		line = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' {
+				return -1
+			}
+			return r
+		}, line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 1 && len(lines[0]) == 2*MRZ_LINE_LENGTH {
+		lines = []string{lines[0][:MRZ_LINE_LENGTH], lines[0][MRZ_LINE_LENGTH:]}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseMrz reads a normalized TD3 MRZ and checks every check digit.
+func parseMrz(text string) (Mrz, error) {
+	lines := strings.Split(text, "\n")
+	if len(lines) != 2 || len(lines[0]) != MRZ_LINE_LENGTH || len(lines[1]) != MRZ_LINE_LENGTH || lines[0][0] != 'P' {
+		return Mrz{}, errMrzFormat
+	}
+	for _, line := range lines {
+		for _, r := range line {
+			if mrzValue(r) < 0 {
+				return Mrz{}, fmt.Errorf("the MRZ cannot contain %q", r)
+			}
+		}
+	}
+	line1, line2 := lines[0], lines[1]
+	checks := []struct {
+		name  string
+		value string
+		digit byte
+	}{
+		{"document number", line2[0:9], line2[9]},
+		{"date of birth", line2[13:19], line2[19]},
+		{"expiry date", line2[21:27], line2[27]},
+		{"personal number", line2[28:42], line2[42]},
+		{"composite", line2[0:10] + line2[13:20] + line2[21:43], line2[43]},
+	}
+	for _, check := range checks {
+		// an empty personal number may have a filler for its check digit
+		if check.name == "personal number" && check.digit == '<' && strings.Trim(check.value, "<") == "" {
+			continue
+		}
+		if check.digit != mrzCheckDigit(check.value) {
+			return Mrz{}, fmt.Errorf("the %s check digit does not match", check.name)
+		}
+	}
+	m := Mrz{
+		DocumentType:   strings.TrimRight(line1[0:2], "<"),
+		IssuingState:   strings.TrimRight(line1[2:5], "<"),
+		Number:         strings.TrimRight(line2[0:9], "<"),
+		Nationality:    strings.TrimRight(line2[10:13], "<"),
+		Sex:            strings.TrimRight(line2[20:21], "<"),
+		PersonalNumber: strings.TrimRight(line2[28:42], "<"),
+		NameTruncated:  line1[MRZ_LINE_LENGTH-1] != '<'}
+	names := strings.SplitN(strings.TrimRight(line1[5:], "<"), "<<", 2)
+	m.Surname = mrzText(names[0])
+	if len(names) == 2 {
+		m.GivenNames = mrzText(names[1])
+	}
+	var err error
+	if m.Dob, err = mrzDate(line2[13:19], true); err != nil {
+		return Mrz{}, errors.New("the date of birth is not a valid date")
+	}
+	if m.Expiry, err = mrzDate(line2[21:27], false); err != nil {
+		return Mrz{}, errors.New("the expiry date is not a valid date")
+	}
+	if m.Sex != "" && m.Sex != "M" && m.Sex != "F" && m.Sex != "X" {
+		return Mrz{}, errors.New("the sex must be M, F, X or <")
+	}
+	return m, nil
+}
+
+// mrzValue is the value of a character for check digits, or -1 if it
+// cannot appear in an MRZ.
+func mrzValue(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0')
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A') + 10
+	case r == '<':
+		return 0
+	}
+	return -1
+}
+
+// mrzCheckDigit weights the values 7, 3, 1 in turn and sums them mod 10.
+func mrzCheckDigit(value string) byte {
+	weights := []int{7, 3, 1}
+	sum := 0
+	for i, r := range value {
+		sum += mrzValue(r) * weights[i%3]
+	}
+	return byte('0' + sum%10)
+}
+
+func mrzText(value string) string {
+	return strings.TrimSpace(strings.Replace(value, "<", " ", -1))
+}
+
+// mrzDate parses YYMMDD. Years only have two digits, so a date of birth is
+// put in the last hundred years and an expiry date in this century.
+func mrzDate(value string, past bool) (time.Time, error) {
+	date, err := time.Parse("060102", value)
+	if err != nil {
+		return date, err
+	}
+	year := 2000 + date.Year()%100
+	if past && year > time.Now().Year() {
+		year -= 100
+	}
+	return time.Date(year, date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// mrzCountry turns an MRZ state code into an ISO 3166-1 alpha-2 code, or
+// returns it as it is if it is not a country (such as XXA, stateless).
+func mrzCountry(code string) string {
+	if alpha2, ok := MRZ_COUNTRY_CODES[code]; ok {
+		return alpha2
+	}
+	if country, ok := countryByAlpha3(code); ok {
+		return country.Code
+	}
+	return code
+}
+
+func (m Mrz) Name() string {
+	return strings.TrimSpace(m.GivenNames + " " + m.Surname)
+}
+
+func (m Mrz) Expired() bool {
+	return m.Expiry.Before(time.Now())
+}
+
+// mismatches compares m with the member's details and the expiry dates of
+// their passport documents.
+func (m Mrz) mismatches(person Person, documents []MemberDocument) []MrzMismatch {
+	var mismatches []MrzMismatch
+	add := func(field string, mrz string, member string) {
+		mismatches = append(mismatches, MrzMismatch{field, mrz, member})
+	}
+	if !mrzNameMatches(m, person.Name) {
+		add("Name", m.Name(), person.Name)
+	}
+	if nationality := mrzCountry(m.Nationality); !strings.EqualFold(nationality, person.Nationality) {
+		add("Nationality", countryName(nationality), countryName(person.Nationality))
+	}
+	if !m.Dob.Equal(person.Dob) {
+		add("Date of birth", m.Dob.Format(DOB_LAYOUT), dateText(person.Dob))
+	}
+	if sex := map[string]Gender{"M": GENDER_MALE, "F": GENDER_FEMALE}[m.Sex]; sex != "" && sex != person.Gender {
+		add("Gender", string(sex), string(person.Gender))
+	}
+	if passport, _ := normalizePassport(person.Passport); m.Number != passport {
+		add("Passport number", m.Number, person.Passport)
+	}
+	var expiries []string
+	for _, document := range documents {
+		if document.Type != DOCUMENT_PASSPORT || document.Expirydate.IsZero() {
+			continue
+		}
+		if document.Expirydate.Equal(m.Expiry) {
+			expiries = nil
+			break
+		}
+		expiries = append(expiries, document.Expirydate.Format(DOB_LAYOUT))
+	}
+	if len(expiries) > 0 {
+		add("Expiry date", m.Expiry.Format(DOB_LAYOUT), strings.Join(expiries, ", ")+" (passport documents)")
+	}
+	return mismatches
+}
+
+// mrzNameMatches compares names word by word in any order, after the
+// transliteration passports use. A truncated MRZ name may end part way
+// through a word, and leave out the words after it.
+func mrzNameMatches(m Mrz, name string) bool {
+	mrzWords := strings.Fields(m.Surname + " " + m.GivenNames)
+	nameWords := strings.Fields(mrzTransliterate(name))
+	unused := map[string]int{}
+	for _, word := range nameWords {
+		unused[word]++
+	}
+	for i, word := range mrzWords {
+		if unused[word] > 0 {
+			unused[word]--
+			continue
+		}
+		if !m.NameTruncated || i != len(mrzWords)-1 {
+			return false
+		}
+		found := false
+		for candidate, count := range unused {
+			if count > 0 && strings.HasPrefix(candidate, word) {
+				unused[candidate]--
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.NameTruncated {
+		return true
+	}
+	for _, count := range unused {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MRZ_TRANSLITERATION follows the Latin recommendations of 9303 part 3.
+var MRZ_TRANSLITERATION = strings.NewReplacer(
+	"Ä", "AE", "Å", "AA", "Æ", "AE", "Ö", "OE", "Ø", "OE", "Ü", "UE", "ß", "SS", "Þ", "TH", "Œ", "OE",
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ç", "C", "È", "E", "É", "E", "Ê", "E", "Ë", "E",
+	"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ð", "D", "Ñ", "N", "Ò", "O", "Ó", "O", "Ô", "O",
+	"Õ", "O", "Ù", "U", "Ú", "U", "Û", "U", "Ý", "Y", "Ÿ", "Y", "Ł", "L", "Š", "S", "Ž", "Z",
+	"Č", "C", "Ć", "C", "Ř", "R", "Ě", "E", "Ą", "A", "Ę", "E", "Ń", "N", "Ś", "S", "Ź", "Z", "Ż", "Z")
+
+// mrzTransliterate uppercases name into MRZ letters. Apostrophes are
+// dropped and anything else separates words, as on a passport.
+func mrzTransliterate(name string) string {
+	name = MRZ_TRANSLITERATION.Replace(strings.ToUpper(name))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r
+		case r == '\'' || r == '’':
+			return -1
+		}
+		return ' '
+	}, name)
+}
+
+// reviewMrz parses and compares a member's MRZ for the review page. It
+// returns nil when the member has none.
+func reviewMrz(person Person, documents []MemberDocument) *MrzReview {
+	if person.Mrz == "" {
+		return nil
+	}
+	review := &MrzReview{Text: person.Mrz}
+	m, err := parseMrz(person.Mrz)
+	if err != nil {
+		review.Error = err.Error()
+		return review
+	}
+	review.Mrz = m
+	review.Mismatches = m.mismatches(person, documents)
+	return review
+}
+
+// readMrz reads an optional MRZ from the form field of req.
+func readMrz(req *http.Request, field string, errs FieldErrors) string {
+	text := normalizeMrz(req.FormValue(field))
+	if text == "" {
+		return ""
+	}
+	if _, err := parseMrz(text); err != nil {
+		errs[field] = "Please check the MRZ: " + err.Error() + "."
+	}
+	return text
+}
+
+// memberMrzHandler records the MRZ an admin entered for a member, or
+// removes it when the field is left empty.
+func memberMrzHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	before, err := personStore.GetByID(req.URL.Query().Get("id"))
+	if err != nil {
+		return err
+	}
+	userName := before.Username
+	errs := FieldErrors{}
+	text := readMrz(req, "mrz", errs)
+	if problem, ok := errs["mrz"]; ok {
+		session, _ := STORE.Get(req, ADMIN_SESSION)
+		session.AddFlash(problem)
+		session.Save(req, res)
+		http.Redirect(res, req, memberURL("/view-user", before), http.StatusSeeOther)
+		return nil
+	}
+	after := before
+	after.Mrz = text
+	if err := recordAudit(req, AUDIT_MRZ_UPDATE, userName, "", before, after); err != nil {
+		return err
+	}
+	if err := personStore.UpdateMrz(userName, text); err != nil {
+		return err
+	}
+	http.Redirect(res, req, memberURL("/view-user", before)+"#mrz", http.StatusSeeOther)
+	return nil
+}
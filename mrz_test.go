@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The specimen from ICAO Doc 9303 part 4.
+var mrzSpecimen = "P<UTOERIKSSON<<ANNA<MARIA<<<<<<<<<<<<<<<<<<<\n" +
+	"L898902C36UTO7408122F1204159ZE184226B<<<<<10"
+
+func TestMrzCheckDigit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  byte
+	}{
+		{"L898902C3", '6'},
+		{"740812", '2'},
+		{"120415", '9'},
+		{"ZE184226B<<<<<", '1'},
+		{"L898902C3674081221204159ZE184226B<<<<<1", '0'},
+		{"<<<<<<<<<", '0'},
+		{"520727", '3'},
+	}
+	for _, test := range tests {
+		if got := mrzCheckDigit(test.value); got != test.want {
+			t.Errorf("mrzCheckDigit(%q) = %c, want %c", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseMrz(t *testing.T) {
+	line1, line2 := mrzSpecimen[:MRZ_LINE_LENGTH], mrzSpecimen[MRZ_LINE_LENGTH+1:]
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{"specimen", mrzSpecimen, ""},
+		{"one line", line1, "two lines"},
+		{"short line", line1 + "\n" + line2[:43], "two lines"},
+		{"not a passport", "I" + line1[1:] + "\n" + line2, "two lines"},
+		{"bad character", line1 + "\n" + "l" + line2[1:], "cannot contain"},
+		{"document number", line1 + "\n" + line2[:9] + "7" + line2[10:], "document number check digit"},
+		{"date of birth", line1 + "\n" + line2[:19] + "3" + line2[20:], "date of birth check digit"},
+		{"expiry date", line1 + "\n" + line2[:27] + "8" + line2[28:], "expiry date check digit"},
+		{"personal number", line1 + "\n" + line2[:42] + "2" + line2[43:], "personal number check digit"},
+		{"composite", line1 + "\n" + line2[:43] + "1", "composite check digit"},
+	}
+	for _, test := range tests {
+		_, err := parseMrz(test.text)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: parseMrz error = %v", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: parseMrz error = %v, want one about %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestParseMrzFields(t *testing.T) {
+	m, err := parseMrz(normalizeMrz(strings.ToLower(strings.Replace(mrzSpecimen, "\n", " ", 1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Mrz{
+		DocumentType:   "P",
+		IssuingState:   "UTO",
+		Surname:        "ERIKSSON",
+		GivenNames:     "ANNA MARIA",
+		Number:         "L898902C3",
+		Nationality:    "UTO",
+		Dob:            time.Date(1974, 8, 12, 0, 0, 0, 0, time.UTC),
+		Sex:            "F",
+		Expiry:         time.Date(2012, 4, 15, 0, 0, 0, 0, time.UTC),
+		PersonalNumber: "ZE184226B"}
+	if m != want {
+		t.Errorf("parseMrz = %+v, want %+v", m, want)
+	}
+	if !m.Expired() {
+		t.Error("the specimen expired in 2012")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing
+//
+// Hashes are stored as "$<scheme>$v=<version>$..." so the version says how
+// to check them. Version 1, the current one, is
+// "$bcrypt-sha256$v=1$<bcrypt hash>": bcrypt at PASSWORD_BCRYPT_COST of the
+// base64 SHA-256 of the password, so passwords longer than bcrypt's 72 bytes
+// are not cut short. Hashes at another cost rehash on next login.
+var PASSWORD_HASH_VERSION = 1
+var PASSWORD_BCRYPT_PREFIX = "$bcrypt-sha256$"
+var PASSWORD_BCRYPT_COST = 12
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// hashPassword returns the encoded hash of password using the current version.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(bcryptInput(password), PASSWORD_BCRYPT_COST)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sv=%d$%s", PASSWORD_BCRYPT_PREFIX, PASSWORD_HASH_VERSION, hash), nil
+}
+
+// bcryptInput is what bcrypt hashes for password: 44 bytes whatever its
+// length, with no NUL bytes.
+func bcryptInput(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// changeMemberPassword sets a member's new password and logs them out of
+// every session started with the old one.
+func changeMemberPassword(username string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := personStore.UpdatePassword(username, hash); err != nil {
+		return err
+	}
+	revokeSessions(USER_SESSION, username)
+	return nil
+}
+
+// Password policy for members. Length matters more than character classes;
+// the upper bound keeps hashing cheap for hostile input.
+var PASSWORD_MIN_LENGTH = 10
+var PASSWORD_MAX_LENGTH = 128
+
+// COMMON_PASSWORDS are refused outright, compared lowercased.
+var COMMON_PASSWORDS = map[string]bool{
+	"1234567890": true, "12345678910": true, "0123456789": true, "1q2w3e4r5t": true,
+	"qwertyuiop": true, "1qaz2wsx3edc": true, "password12": true, "password123": true,
+	"password1234": true, "passw0rd123": true, "iloveyou123": true, "welcome123": true,
+	"letmein123": true, "administrator": true, "qwerty12345": true, "qwerty123456": true,
+	"abcdefghij": true, "abc1234567": true, "football123": true, "baseball123": true,
+	"sunshine123": true, "princess123": true, "monkey1234": true, "dragon1234": true,
+	"1111111111": true, "0000000000": true, "aaaaaaaaaa": true, "wistoken123": true,
+}
+
+// checkNewPassword returns what is wrong with a new password for the
+// member with username and email, or "" if it can be used.
+func checkNewPassword(password string, confirm string, username string, email string) string {
+	if password == "" {
+		return "Please choose a new password."
+	}
+	if password != confirm {
+		return "The passwords do not match."
+	}
+	if utf8.RuneCountInString(password) < PASSWORD_MIN_LENGTH {
+		return fmt.Sprintf("Please use at least %d characters.", PASSWORD_MIN_LENGTH)
+	}
+	if utf8.RuneCountInString(password) > PASSWORD_MAX_LENGTH {
+		return fmt.Sprintf("Please use at most %d characters.", PASSWORD_MAX_LENGTH)
+	}
+	lower := strings.ToLower(password)
+	if COMMON_PASSWORDS[lower] {
+		return "That password is too common. Please choose another."
+	}
+	local := strings.ToLower(email)
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	for _, part := range []string{strings.ToLower(username), local} {
+		if len(part) >= 3 && strings.Contains(lower, part) {
+			return "Your password must not contain your username or email address."
+		}
+	}
+	return ""
+}
+
+var dummyPasswordHash string
+var dummyPasswordHashOnce sync.Once
+
+// verifyLoginPassword is verifyPassword for a login form. Unknown usernames
+// have no stored hash; checking against a throwaway one makes them take as
+// long as known ones, so response times do not tell which usernames exist.
+func verifyLoginPassword(stored, password string) (match bool, needsRehash bool) {
+	if stored == "" {
+		dummyPasswordHashOnce.Do(func() { dummyPasswordHash, _ = hashPassword("") })
+		verifyPassword(dummyPasswordHash, password)
+		return false, false
+	}
+	return verifyPassword(stored, password)
+}
+
+// verifyPassword reports whether password matches the stored value, and
+// whether the stored value should be replaced with a fresh hash. Stored values
+// without a hash prefix are legacy plaintext records.
+func verifyPassword(stored, password string) (match bool, needsRehash bool) {
+	if strings.HasPrefix(stored, PASSWORD_BCRYPT_PREFIX) {
+		hash, err := decodeBcryptHash(stored)
+		if err != nil {
+			return false, false
+		}
+		if bcrypt.CompareHashAndPassword(hash, bcryptInput(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(hash)
+		return true, err != nil || cost != PASSWORD_BCRYPT_COST
+	}
+	match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return match, match
+}
+
+func decodeBcryptHash(stored string) ([]byte, error) {
+	version := fmt.Sprintf("v=%d$", PASSWORD_HASH_VERSION)
+	rest := strings.TrimPrefix(stored, PASSWORD_BCRYPT_PREFIX)
+	if !strings.HasPrefix(rest, version) || len(rest) == len(version) {
+		return nil, errInvalidPasswordHash
+	}
+	return []byte(rest[len(version):]), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	cost := PASSWORD_BCRYPT_COST
+	PASSWORD_BCRYPT_COST = bcrypt.MinCost
+	defer func() { PASSWORD_BCRYPT_COST = cost }()
+
+	current, err := hashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(current, "$bcrypt-sha256$v=1$") {
+		t.Fatalf("hashPassword = %q, want a version 1 bcrypt hash", current)
+	}
+	// bcrypt alone would stop at 72 bytes; these differ only after that
+	long := strings.Repeat("a", 80)
+	longHash, err := hashPassword(long + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCost, err := bcrypt.GenerateFromPassword(bcryptInput("correct horse battery"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		stored      string
+		password    string
+		match       bool
+		needsRehash bool
+	}{
+		{"current", current, "correct horse battery", true, false},
+		{"current wrong password", current, "correct horse batterY", false, false},
+		{"past 72 bytes", longHash, long + "1", true, false},
+		{"past 72 bytes wrong password", longHash, long + "2", false, false},
+		{"other cost", "$bcrypt-sha256$v=1$" + string(otherCost), "correct horse battery", true, true},
+		{"no hash", "$bcrypt-sha256$v=1$", "correct horse battery", false, false},
+		{"unknown version", "$bcrypt-sha256$v=2$" + string(otherCost), "correct horse battery", false, false},
+		{"legacy plaintext", "correct horse battery", "correct horse battery", true, true},
+		{"legacy plaintext wrong password", "correct horse battery", "wrong", false, false},
+	}
+	for _, test := range tests {
+		match, needsRehash := verifyPassword(test.stored, test.password)
+		if match != test.match || needsRehash != test.needsRehash {
+			t.Errorf("%s: verifyPassword = %v, %v, want %v, %v", test.name, match, needsRehash, test.match, test.needsRehash)
+		}
+	}
+}
+
+func TestVerifyLoginPasswordUnknownUser(t *testing.T) {
+	cost := PASSWORD_BCRYPT_COST
+	PASSWORD_BCRYPT_COST = bcrypt.MinCost
+	defer func() { PASSWORD_BCRYPT_COST = cost }()
+
+	for _, password := range []string{"", "anything"} {
+		if match, needsRehash := verifyLoginPassword("", password); match || needsRehash {
+			t.Errorf("verifyLoginPassword(\"\", %q) = %v, %v, want false, false", password, match, needsRehash)
+		}
+	}
+}
+
+func TestCheckNewPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		confirm  string
+		ok       bool
+	}{
+		{"Kp4-violet-desk", "Kp4-violet-desk", true},
+		{"", "", false},
+		{"Kp4-violet-desk", "Kp4-violet-dusk", false},
+		{"short", "short", false},
+		{strings.Repeat("x", PASSWORD_MAX_LENGTH+1), strings.Repeat("x", PASSWORD_MAX_LENGTH+1), false},
+		{"Password123", "Password123", false},
+		{"my-bobby-password", "my-bobby-password", false},
+		{"Ann.Smith-2024", "Ann.Smith-2024", false},
+	}
+	for _, test := range tests {
+		problem := checkNewPassword(test.password, test.confirm, "bobby", "ann.smith@example.com")
+		if (problem == "") != test.ok {
+			t.Errorf("checkNewPassword(%q, %q) = %q, want ok %v", test.password, test.confirm, problem, test.ok)
+		}
+	}
+}
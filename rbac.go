@@ -0,0 +1,247 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/context"
+)
+
+// Back-office roles
+//
+// Each admin has one role. What a role may do is ROLE_PERMISSIONS, and
+// what each admin route needs is ADMIN_ROUTE_PERMISSIONS; RequireAdmin
+// checks one against the other for every request.
+type Role string
+type Permission string
+
+var ROLE_SUPER_ADMIN = Role("super_admin")
+var ROLE_COMPLIANCE_OFFICER = Role("compliance_officer")
+var ROLE_REVIEWER = Role("reviewer")
+var ROLE_AUDITOR = Role("auditor")
+
+// Role given to admins created before roles existed.
+var ROLE_LEGACY = ROLE_REVIEWER
+
+var ROLES = []RoleOption{
+	{ROLE_SUPER_ADMIN, "Super admin"},
+	{ROLE_COMPLIANCE_OFFICER, "Compliance officer"},
+	{ROLE_REVIEWER, "Reviewer"},
+	{ROLE_AUDITOR, "Read-only auditor"},
+}
+
+var PERM_VIEW_MEMBERS = Permission("view_members")
+var PERM_EDIT_MEMBERS = Permission("edit_members")
+var PERM_REMOVE_MEMBERS = Permission("remove_members")
+var PERM_REVIEW_KYC = Permission("review_kyc")
+var PERM_REVIEW_DOCUMENTS = Permission("review_documents")
+var PERM_VIEW_AUDIT = Permission("view_audit")
+var PERM_MANAGE_ADMINS = Permission("manage_admins")
+var PERM_MANAGE_SESSIONS = Permission("manage_sessions")
+var PERM_UNLOCK_LOGINS = Permission("unlock_logins")
+
+var ROLE_PERMISSIONS = map[Role][]Permission{
+	ROLE_SUPER_ADMIN: {PERM_VIEW_MEMBERS, PERM_EDIT_MEMBERS, PERM_REMOVE_MEMBERS, PERM_REVIEW_KYC,
+		PERM_REVIEW_DOCUMENTS, PERM_VIEW_AUDIT, PERM_MANAGE_ADMINS, PERM_MANAGE_SESSIONS,
+		PERM_UNLOCK_LOGINS},
+	ROLE_COMPLIANCE_OFFICER: {PERM_VIEW_MEMBERS, PERM_EDIT_MEMBERS, PERM_REMOVE_MEMBERS, PERM_REVIEW_KYC,
+		PERM_REVIEW_DOCUMENTS, PERM_VIEW_AUDIT, PERM_MANAGE_SESSIONS, PERM_UNLOCK_LOGINS},
+	ROLE_REVIEWER: {PERM_VIEW_MEMBERS, PERM_REVIEW_KYC, PERM_REVIEW_DOCUMENTS},
+	ROLE_AUDITOR:  {PERM_VIEW_MEMBERS, PERM_VIEW_AUDIT},
+}
+
+// ADMIN_ROUTE_PERMISSIONS maps each admin route to the permission needed per
+// method; the "" entry covers every other method.
+var ADMIN_ROUTE_PERMISSIONS = map[string]map[string]Permission{
+	"/admin-dashboard":      {"": PERM_VIEW_MEMBERS},
+	"/view-new-members":     {"": PERM_VIEW_MEMBERS},
+	"/edit-new-members":     {"": PERM_EDIT_MEMBERS},
+	"/remove-new-members":   {"": PERM_REMOVE_MEMBERS},
+	"/kyc-approved-members": {"": PERM_VIEW_MEMBERS},
+	"/kyc-pending-members":  {"": PERM_VIEW_MEMBERS},
+	"/all-members":          {"": PERM_VIEW_MEMBERS},
+	"/view-user":            {"": PERM_VIEW_MEMBERS, "POST": PERM_REVIEW_KYC},
+	"/view-user-final":      {"": PERM_VIEW_MEMBERS},
+	"/edit-user":            {"": PERM_EDIT_MEMBERS},
+	"/remove-user":          {"": PERM_REMOVE_MEMBERS},
+	"/document":             {"": PERM_VIEW_MEMBERS},
+	"/review-document":      {"": PERM_REVIEW_DOCUMENTS},
+	"/member-mrz":           {"": PERM_REVIEW_KYC},
+	"/audit-log":            {"": PERM_VIEW_AUDIT},
+	"/admin-registration":   {"": PERM_MANAGE_ADMINS},
+	"/admins":               {"": PERM_MANAGE_ADMINS},
+	"/sessions":             {"": PERM_MANAGE_SESSIONS},
+	"/lockouts":             {"": PERM_UNLOCK_LOGINS},
+}
+
+type RoleOption struct {
+	Value Role
+	Label string
+}
+
+func (r Role) valid() bool {
+	_, ok := ROLE_PERMISSIONS[r]
+	return ok
+}
+
+func (r Role) Label() string {
+	for _, option := range ROLES {
+		if option.Value == r {
+			return option.Label
+		}
+	}
+	return string(r)
+}
+
+func (r Role) can(permission Permission) bool {
+	for _, granted := range ROLE_PERMISSIONS[r] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentRole is the admin's role, mapping admins created before roles
+// existed onto ROLE_LEGACY.
+func (a AdminPerson) CurrentRole() Role {
+	if !a.Role.valid() {
+		return ROLE_LEGACY
+	}
+	return a.Role
+}
+
+// Can reports whether the admin holds permission, for templates.
+func (a AdminPerson) Can(permission string) bool {
+	return a.CurrentRole().can(Permission(permission))
+}
+
+// adminPermission is what ADMIN_ROUTE_PERMISSIONS requires for method on
+// pattern. Every admin route must be listed there.
+func adminPermission(method string, pattern string) Permission {
+	methods, ok := ADMIN_ROUTE_PERMISSIONS[pattern]
+	if !ok {
+		panic("rbac: no permissions defined for " + pattern)
+	}
+	if permission, ok := methods[method]; ok {
+		return permission
+	}
+	return methods[""]
+}
+
+// allowFirstAdmin lets the very first admin register without logging in;
+// once any admin exists the route is guarded like any other admin page.
+// handler learns which through registeringFirstAdmin.
+func allowFirstAdmin(method string, pattern string, handler appHandler) appHandler {
+	guarded := RequireAdmin(adminPermission(method, pattern), handler)
+	return func(res http.ResponseWriter, req *http.Request) error {
+		first, err := isFirstAdmin()
+		if err != nil {
+			return err
+		}
+		if first {
+			context.Set(req, firstAdminKey, true)
+			return handler(res, req)
+		}
+		return guarded(res, req)
+	}
+}
+
+// registeringFirstAdmin reports whether allowFirstAdmin let req through
+// because no admin exists yet.
+func registeringFirstAdmin(req *http.Request) bool {
+	first, _ := context.Get(req, firstAdminKey).(bool)
+	return first
+}
+
+// warnIfNoSuperAdmin points out that nobody can manage admins, which is the
+// case for databases created before roles existed.
+func warnIfNoSuperAdmin() {
+	admins, err := adminStore.List()
+	if err != nil || len(admins) == 0 {
+		return
+	}
+	for _, admin := range admins {
+		if admin.CurrentRole() == ROLE_SUPER_ADMIN {
+			return
+		}
+	}
+	log.Printf("No super admin exists; grant one with: %s admin role <username> %s", os.Args[0], ROLE_SUPER_ADMIN)
+}
+
+// adminsPageHandler lists admins for a super admin to change their roles,
+// reset their two-factor login or remove them. Nobody can change or remove
+// their own account here, so there is always at least the current super
+// admin left.
+func adminsPageHandler(res http.ResponseWriter, req *http.Request) error {
+	admins, err := adminStore.List()
+	if err != nil {
+		return err
+	}
+	session, _ := STORE.Get(req, ADMIN_SESSION)
+	var message interface{}
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message = flashes
+	}
+	session.Save(req, res)
+	return renderTemplate(res, req, http.StatusOK, "admins.html", map[string]interface{}{
+		"admins":  admins,
+		"roles":   ROLES,
+		"self":    currentAdmin(req).Username,
+		"message": message})
+}
+
+func adminsSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	username := req.FormValue("username")
+	before, err := adminStore.Get(username)
+	if err != nil {
+		return err
+	}
+	if username == currentAdmin(req).Username {
+		session, _ := STORE.Get(req, ADMIN_SESSION)
+		session.AddFlash("You cannot change your own account.")
+		session.Save(req, res)
+		http.Redirect(res, req, "/admins", http.StatusSeeOther)
+		return nil
+	}
+	switch req.FormValue("action") {
+	case "role":
+		role := Role(req.FormValue("role"))
+		if !role.valid() {
+			return statusError(http.StatusBadRequest, "")
+		}
+		after := before
+		after.Role = role
+		if err := recordAudit(req, AUDIT_ADMIN_ROLE, username, "", before, after); err != nil {
+			return err
+		}
+		if err := adminStore.UpdateRole(username, role); err != nil {
+			return err
+		}
+	case "remove":
+		if err := recordAudit(req, AUDIT_ADMIN_REMOVE, username, "", before, nil); err != nil {
+			return err
+		}
+		if err := adminStore.Delete(username); err != nil {
+			return err
+		}
+		revokeSessions(ADMIN_SESSION, username)
+	case "reset_totp":
+		after := before
+		AdminTotp{}.apply(&after)
+		if err := recordAudit(req, AUDIT_TOTP_RESET, username, "", before, after); err != nil {
+			return err
+		}
+		if err := resetTotp(username); err != nil {
+			return err
+		}
+	default:
+		return statusError(http.StatusBadRequest, "")
+	}
+	http.Redirect(res, req, "/admins", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// Routing
+//
+// Routes are registered per method, and a path requested with a method it
+// has no handler for gets a 405. Admin and member pages go through
+// RequireAdmin and RequireMember, which send anonymous visitors to the
+// login page and put the logged in principal in the request context.
+type Router struct {
+	mux     *http.ServeMux
+	routes  map[string]map[string]http.Handler
+	handler http.Handler
+}
+
+type contextKey int
+
+const adminKey contextKey = 0
+const memberKey contextKey = 1
+const firstAdminKey contextKey = 2
+
+func newRouter() *Router {
+	mux := http.NewServeMux()
+	return &Router{mux, map[string]map[string]http.Handler{}, context.ClearHandler(recoverPanics(requireDatabase(secureCookies(csrfProtect(mux)))))}
+}
+
+// ServeHTTP turns req away while the database is unreachable, otherwise
+// checks its CSRF token and dispatches it, then clears the request
+// context; the session registry lives there too. A handler that panics
+// gets a 500 for that request alone.
+func (r *Router) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(res, req)
+}
+
+func (r *Router) Handle(method string, pattern string, handler http.Handler) {
+	methods, ok := r.routes[pattern]
+	if !ok {
+		methods = map[string]http.Handler{}
+		r.routes[pattern] = methods
+		r.mux.HandleFunc(pattern, func(res http.ResponseWriter, req *http.Request) {
+			// "/" also catches every path without a route of its own, which
+			// is not found whatever the method
+			if pattern == "/" && req.URL.Path != "/" {
+				renderError(res, req, errNotFound)
+				return
+			}
+			handler, ok := methods[req.Method]
+			if !ok && req.Method == "HEAD" {
+				handler, ok = methods["GET"]
+			}
+			if !ok {
+				allowed := []string{}
+				for method := range methods {
+					allowed = append(allowed, method)
+				}
+				sort.Strings(allowed)
+				res.Header().Set("Allow", strings.Join(allowed, ", "))
+				renderError(res, req, statusError(http.StatusMethodNotAllowed, ""))
+				return
+			}
+			handler.ServeHTTP(res, req)
+		})
+	}
+	methods[method] = handler
+}
+
+func (r *Router) Get(pattern string, handler appHandler) {
+	r.Handle("GET", pattern, handler)
+}
+
+func (r *Router) Post(pattern string, handler appHandler) {
+	r.Handle("POST", pattern, handler)
+}
+
+// Admin registers an admin page, guarded by the permission
+// ADMIN_ROUTE_PERMISSIONS gives it for method.
+func (r *Router) Admin(method string, pattern string, handler appHandler) {
+	r.Handle(method, pattern, RequireAdmin(adminPermission(method, pattern), handler))
+}
+
+// Member registers a page for logged in members.
+func (r *Router) Member(method string, pattern string, handler appHandler) {
+	r.Handle(method, pattern, RequireMember(handler))
+}
+
+// AdminAccount registers a page every logged in admin may use for their own
+// account, such as enrolling in two-factor login.
+func (r *Router) AdminAccount(method string, pattern string, handler appHandler) {
+	r.Handle(method, pattern, RequireAdmin("", handler))
+}
+
+// RequireAdmin only calls handler for a logged in admin whose role has
+// permission. The admin is loaded on every request so role changes apply at
+// once, and is available to handler through currentAdmin. While two-factor
+// login is required, admins who have not enrolled are sent to do so. An
+// empty permission skips the permission and enrolment checks.
+func RequireAdmin(permission Permission, handler appHandler) appHandler {
+	return func(res http.ResponseWriter, req *http.Request) error {
+		session, _ := STORE.Get(req, ADMIN_SESSION)
+		auth, ok := session.Values[AUTHENTICATED].(bool)
+		admin_auth, admin_ok := session.Values[PERSON_TYPE].(string)
+		username, _ := session.Values["username"].(string)
+		if !(ok && auth) || !(admin_ok && admin_auth == USER_ADMIN) || username == "" {
+			redirectToLogin(res, req, "/admin-login")
+			return nil
+		}
+		admin, err := adminStore.Get(username)
+		if err == errNotFound {
+			endSession(req, res, session)
+			redirectToLogin(res, req, "/admin-login")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		context.Set(req, adminKey, admin)
+		if permission != "" {
+			if ADMIN_TOTP == ADMIN_TOTP_REQUIRED && !admin.Totpenabled {
+				http.Redirect(res, req, "/totp-setup", http.StatusSeeOther)
+				return nil
+			}
+			if !admin.CurrentRole().can(permission) {
+				return statusError(http.StatusForbidden, "You do not have permission to do that.")
+			}
+		}
+		return handler(res, req)
+	}
+}
+
+// RequireMember only calls handler for a logged in member. The member is
+// loaded on every request, so handler always sees their current profile and
+// status through currentMember.
+func RequireMember(handler appHandler) appHandler {
+	return func(res http.ResponseWriter, req *http.Request) error {
+		session, _ := STORE.Get(req, USER_SESSION)
+		auth, ok := session.Values[AUTHENTICATED].(bool)
+		user_auth, user_ok := session.Values[PERSON_TYPE].(string)
+		username, _ := session.Values["username"].(string)
+		if !(ok && auth) || !(user_ok && user_auth == USER_PERSON) || username == "" {
+			redirectToLogin(res, req, "/login")
+			return nil
+		}
+		person, err := personStore.Get(username)
+		if err == errNotFound {
+			endSession(req, res, session)
+			redirectToLogin(res, req, "/login")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		person.Password = ""
+		person.Document = nil
+		context.Set(req, memberKey, &person)
+		return handler(res, req)
+	}
+}
+
+// currentAdmin is the admin RequireAdmin let through; the zero AdminPerson
+// outside of it.
+func currentAdmin(req *http.Request) AdminPerson {
+	admin, _ := context.Get(req, adminKey).(AdminPerson)
+	return admin
+}
+
+func currentMember(req *http.Request) *Person {
+	person, _ := context.Get(req, memberKey).(*Person)
+	return person
+}
+
+// redirectToLogin sends the visitor to login, coming back to the page they
+// asked for afterwards. Only GET requests can be replayed that way.
+func redirectToLogin(res http.ResponseWriter, req *http.Request, login string) {
+	if req.Method == "GET" {
+		login += "?next=" + url.QueryEscape(req.URL.RequestURI())
+	}
+	http.Redirect(res, req, login, http.StatusSeeOther)
+}
+
+// safeNext returns next if it is a path on this site, and fallback otherwise,
+// so the login pages cannot be used to redirect elsewhere.
+func safeNext(next string, fallback string) string {
+	u, err := url.Parse(next)
+	if err != nil || next == "" || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(next, "/") ||
+		strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return fallback
+	}
+	return next
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Server-side sessions
+//
+// The session cookie only carries a signed session ID; the values live in
+// the session collection. A session ends SESSION_IDLE_TIMEOUT after its last
+// request or SESSION_MAX_AGE after it started, whichever comes first, and
+// can be revoked at any time by deleting its record.
+var sessionStore SessionStore
+
+var DB_COLLECTION_SESSION string
+var SESSION_IDLE_TIMEOUT time.Duration
+var SESSION_MAX_AGE time.Duration
+
+// How stale a session's lastseen may get before a request refreshes it, so
+// not every request writes to the database.
+var SESSION_TOUCH_INTERVAL = time.Minute
+
+// Who a session belongs to, by cookie name.
+var SESSION_KINDS = map[string]string{USER_SESSION: "member", ADMIN_SESSION: "admin"}
+
+type SessionRecord struct {
+	ID        string    `bson:"_id"`
+	Name      string    `bson:"name"`
+	Username  string    `bson:"username"`
+	Values    []byte    `bson:"values"`
+	Created   time.Time `bson:"created"`
+	Lastseen  time.Time `bson:"lastseen"`
+	Expires   time.Time `bson:"expires"`
+	IP        string    `bson:"ip"`
+	Useragent string    `bson:"useragent"`
+}
+
+// update is what saving a stored session changes; its name, creation time
+// and user agent stay as they were.
+func (r SessionRecord) update() bson.M {
+	return bson.M{
+		"username": r.Username,
+		"values":   r.Values,
+		"lastseen": r.Lastseen,
+		"expires":  r.Expires,
+		"ip":       r.IP}
+}
+
+// expiry is when the session ends unless another request comes in first.
+func (r SessionRecord) expiry() time.Time {
+	idle, absolute := r.Lastseen.Add(SESSION_IDLE_TIMEOUT), r.Created.Add(SESSION_MAX_AGE)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+// Handle identifies the session on admin pages without giving away its ID,
+// which is all it takes to use the session.
+func (r SessionRecord) Handle() string {
+	sum := sha256.Sum256([]byte(r.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (r SessionRecord) Kind() string {
+	if kind, ok := SESSION_KINDS[r.Name]; ok {
+		return kind
+	}
+	return r.Name
+}
+
+// SessionStore keeps session records. List only returns sessions that have
+// not expired and belong to someone, optionally only to username.
+type SessionStore interface {
+	Get(id string) (SessionRecord, error)
+	List(username string) ([]SessionRecord, error)
+	Insert(record SessionRecord) error
+	// Update rewrites a stored session, failing with errNotFound once it
+	// has been revoked.
+	Update(record SessionRecord) error
+	Touch(id string, lastseen time.Time, expires time.Time) error
+	Delete(id string) error
+	DeleteByUser(name string, username string) (int, error)
+}
+
+// Mongo implementation
+
+type mgoSessionStore struct{ mgoCollection }
+
+func newMgoSessionStore(session *mgo.Session) *mgoSessionStore {
+	return &mgoSessionStore{mgoCollection{session, DB_COLLECTION_SESSION}}
+}
+
+func (s *mgoSessionStore) Get(id string) (record SessionRecord, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.FindId(id).One(&record)
+	})
+	return
+}
+
+func (s *mgoSessionStore) List(username string) (records []SessionRecord, err error) {
+	query := bson.M{"username": bson.M{"$ne": ""}, "expires": bson.M{"$gt": time.Now()}}
+	if username != "" {
+		query["username"] = username
+	}
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(query).Sort("username", "-lastseen").All(&records)
+	})
+	return
+}
+
+// Save relies on the TTL index on expires for Mongo to remove expired
+// records on its own.
+func (s *mgoSessionStore) Insert(record SessionRecord) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Insert(record)
+	})
+}
+
+func (s *mgoSessionStore) Update(record SessionRecord) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.UpdateId(record.ID, bson.M{"$set": record.update()})
+	})
+}
+
+func (s *mgoSessionStore) Touch(id string, lastseen time.Time, expires time.Time) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.UpdateId(id, bson.M{"$set": bson.M{"lastseen": lastseen, "expires": expires}})
+	})
+}
+
+func (s *mgoSessionStore) Delete(id string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.RemoveId(id)
+	})
+}
+
+func (s *mgoSessionStore) DeleteByUser(name string, username string) (removed int, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		info, err := c.RemoveAll(bson.M{"name": name, "username": username})
+		if info != nil {
+			removed = info.Removed
+		}
+		return err
+	})
+	return
+}
+
+// In-memory implementation
+
+type memorySessionStore struct{ docs *memoryCollection }
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{newMemoryCollection()}
+}
+
+func (s *memorySessionStore) Get(id string) (record SessionRecord, err error) {
+	err = s.docs.findOne(bson.M{"_id": id}, &record)
+	return
+}
+
+func (s *memorySessionStore) List(username string) ([]SessionRecord, error) {
+	query := bson.M{}
+	if username != "" {
+		query["username"] = username
+	}
+	var records []SessionRecord
+	if err := s.docs.findAll(query, nil, &records); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := []SessionRecord{}
+	for _, record := range records {
+		if record.Username != "" && record.Expires.After(now) {
+			active = append(active, record)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Username != active[j].Username {
+			return active[i].Username < active[j].Username
+		}
+		return active[i].Lastseen.After(active[j].Lastseen)
+	})
+	return active, nil
+}
+
+func (s *memorySessionStore) Insert(record SessionRecord) error {
+	return s.docs.insertUnique(record, "_id")
+}
+
+func (s *memorySessionStore) Update(record SessionRecord) error {
+	return s.docs.update(bson.M{"_id": record.ID}, record.update())
+}
+
+func (s *memorySessionStore) Touch(id string, lastseen time.Time, expires time.Time) error {
+	return s.docs.update(bson.M{"_id": id}, bson.M{"lastseen": lastseen, "expires": expires})
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	return s.docs.remove(bson.M{"_id": id})
+}
+
+func (s *memorySessionStore) DeleteByUser(name string, username string) (int, error) {
+	return s.docs.removeAll(bson.M{"name": name, "username": username})
+}
+
+// ServerStore is a sessions.Store that keeps values in sessionStore and
+// only the signed session ID in the cookie.
+type ServerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newServerStore(keyPairs ...[]byte) *ServerStore {
+	return &ServerStore{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", HttpOnly: true}}
+}
+
+func (s *ServerStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(req).Get(s, name)
+}
+
+// New loads the session req's cookie points to, or starts an empty one if
+// there is none or it has expired or been revoked.
+func (s *ServerStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+	record, err := sessionStore.Get(id)
+	if err == errNotFound {
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	now := time.Now()
+	if record.Name != name || !now.Before(record.expiry()) {
+		if err := sessionStore.Delete(id); err != nil {
+			log.Print("Error deleting expired session: ", err)
+		}
+		return session, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(record.Values)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	if now.Sub(record.Lastseen) >= SESSION_TOUCH_INTERVAL {
+		record.Lastseen = now
+		if err := sessionStore.Touch(id, now, record.expiry()); err != nil {
+			log.Print("Error touching session: ", err)
+		}
+	}
+	return session, nil
+}
+
+// Save writes the session's record and cookie. A negative MaxAge ends the
+// session, and an empty new session is not stored at all, so visitors who
+// never log in or see a flash message leave no record behind.
+func (s *ServerStore) Save(req *http.Request, res http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := sessionStore.Delete(session.ID); err != nil && err != errNotFound {
+				return err
+			}
+		}
+		http.SetCookie(res, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" && len(session.Values) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	record := SessionRecord{
+		ID:        session.ID,
+		Name:      session.Name(),
+		Created:   now,
+		Lastseen:  now,
+		IP:        clientIP(req),
+		Useragent: req.UserAgent()}
+	stored := record.ID != ""
+	if stored {
+		existing, err := sessionStore.Get(record.ID)
+		if err == errNotFound {
+			return s.revoked(res, session)
+		} else if err != nil {
+			return err
+		}
+		record.Created = existing.Created
+	} else {
+		record.ID = newSessionID()
+	}
+	record.Username, _ = session.Values["username"].(string)
+	record.Expires = record.expiry()
+
+	var values bytes.Buffer
+	if err := gob.NewEncoder(&values).Encode(session.Values); err != nil {
+		return err
+	}
+	record.Values = values.Bytes()
+	// a session is only ever updated, never brought back, once it is
+	// stored: a revoked one must stay gone
+	if stored {
+		if err := sessionStore.Update(record); err == errNotFound {
+			return s.revoked(res, session)
+		} else if err != nil {
+			return err
+		}
+	} else if err := sessionStore.Insert(record); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), record.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	session.ID = record.ID
+	http.SetCookie(res, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// revoked drops the cookie of a session that was revoked while the request
+// was running.
+func (s *ServerStore) revoked(res http.ResponseWriter, session *sessions.Session) error {
+	session.Options.MaxAge = -1
+	http.SetCookie(res, sessions.NewCookie(session.Name(), "", session.Options))
+	return nil
+}
+
+func newSessionID() string {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// renewSession gives session a fresh ID the next time it is saved, so an ID
+// planted before login is worthless afterwards.
+func renewSession(session *sessions.Session) {
+	if session.ID != "" {
+		if err := sessionStore.Delete(session.ID); err != nil {
+			log.Print("Error deleting session: ", err)
+		}
+		session.ID = ""
+	}
+}
+
+// endSession deletes session and its cookie.
+func endSession(req *http.Request, res http.ResponseWriter, session *sessions.Session) {
+	session.Options.MaxAge = -1
+	if err := session.Save(req, res); err != nil {
+		log.Print("Error ending session: ", err)
+	}
+}
+
+// revokeSessions logs username out of every device. Members are logged out
+// whenever their password or status changes.
+func revokeSessions(name string, username string) {
+	if _, err := sessionStore.DeleteByUser(name, username); err != nil {
+		log.Print("Error revoking sessions: ", err)
+	}
+}
+
+// logoutAllHandler and adminLogoutAllHandler end every session of the
+// logged in member or admin, on any device.
+func logoutAllHandler(res http.ResponseWriter, req *http.Request) error {
+	return logoutAll(res, req, USER_SESSION)
+}
+
+func adminLogoutAllHandler(res http.ResponseWriter, req *http.Request) error {
+	return logoutAll(res, req, ADMIN_SESSION)
+}
+
+func logoutAll(res http.ResponseWriter, req *http.Request, name string) error {
+	session, _ := STORE.Get(req, name)
+	if username, ok := session.Values["username"].(string); ok && username != "" {
+		revokeSessions(name, username)
+	}
+	endSession(req, res, session)
+	rotateCsrfToken(res, req)
+	http.Redirect(res, req, "/", http.StatusSeeOther)
+	return nil
+}
+
+// sessionsPageHandler lists active sessions, optionally for one username,
+// for an admin to revoke.
+func sessionsPageHandler(res http.ResponseWriter, req *http.Request) error {
+	username := req.URL.Query().Get("u")
+	records, err := sessionStore.List(username)
+	if err != nil {
+		return err
+	}
+	return renderTemplate(res, req, http.StatusOK, "sessions.html", map[string]interface{}{"sessions": records, "username": username})
+}
+
+// sessionsSubmitHandler revokes one session (action=revoke with its handle)
+// or all of a user's sessions of one kind (action=revoke_all).
+func sessionsSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	username, name := req.FormValue("username"), req.FormValue("name")
+	if _, ok := SESSION_KINDS[name]; !ok || username == "" {
+		return statusError(http.StatusBadRequest, "")
+	}
+	switch req.FormValue("action") {
+	case "revoke":
+		records, err := sessionStore.List(username)
+		if err != nil {
+			return err
+		}
+		handle := req.FormValue("session")
+		for _, record := range records {
+			if record.Name == name && record.Handle() == handle {
+				if err := recordAudit(req, AUDIT_SESSION_REVOKE, username, SESSION_KINDS[name]+" "+handle, nil, nil); err != nil {
+					return err
+				}
+				if err := sessionStore.Delete(record.ID); err != nil && err != errNotFound {
+					return err
+				}
+			}
+		}
+	case "revoke_all":
+		if err := recordAudit(req, AUDIT_SESSION_REVOKE, username, SESSION_KINDS[name]+" all", nil, nil); err != nil {
+			return err
+		}
+		revokeSessions(name, username)
+	default:
+		return statusError(http.StatusBadRequest, "")
+	}
+	http.Redirect(res, req, "/sessions?u="+url.QueryEscape(req.FormValue("u")), http.StatusSeeOther)
+	return nil
+}
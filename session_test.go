@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestServerStoreSave(t *testing.T) {
+	useMemoryStores(t)
+	SESSION_IDLE_TIMEOUT, SESSION_MAX_AGE = 30*time.Minute, 12*time.Hour
+	store := newServerStore([]byte("0123456789abcdef0123456789abcdef"))
+	save := func(session *sessions.Session) *httptest.ResponseRecorder {
+		t.Helper()
+		res := httptest.NewRecorder()
+		if err := store.Save(httptest.NewRequest("GET", "/", nil), res, session); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	session := sessions.NewSession(store, USER_SESSION)
+	session.Options = &sessions.Options{Path: "/"}
+	session.Values["username"] = "ann"
+	save(session)
+	record, err := sessionStore.Get(session.ID)
+	if err != nil || record.Username != "ann" {
+		t.Fatalf("new session record = %+v, %v, want ann's", record, err)
+	}
+	if err := sessionStore.Insert(record); err == nil {
+		t.Error("inserting a session twice: want an error")
+	}
+
+	session.Values["flash"] = "saved"
+	if res := save(session); len(res.Result().Cookies()) != 1 || res.Result().Cookies()[0].MaxAge < 0 {
+		t.Errorf("saving a stored session: cookies %v, want the session cookie", res.Result().Cookies())
+	}
+	if updated, err := sessionStore.Get(session.ID); err != nil || !updated.Created.Equal(record.Created) || len(updated.Values) == len(record.Values) {
+		t.Errorf("updated session = %+v, %v, want new values and the same creation time", updated, err)
+	}
+
+	// revoked between the request reading the session and saving it
+	if err := sessionStore.Delete(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionStore.Update(record); err != errNotFound {
+		t.Errorf("updating a revoked session: error = %v, want errNotFound", err)
+	}
+	if res := save(session); len(res.Result().Cookies()) != 1 || res.Result().Cookies()[0].MaxAge >= 0 {
+		t.Errorf("saving a revoked session: cookies %v, want the cookie removed", res.Result().Cookies())
+	}
+	if _, err := sessionStore.Get(session.ID); err != errNotFound {
+		t.Errorf("revoked session after saving: error = %v, want errNotFound", err)
+	}
+}
@@ -1,412 +0,0 @@
-let country = ["Afghanistan",
-"Albania",
-"Algeria",
-"Andorra",
-"Angola",
-"Antigua & Deps",
-"Argentina, Armenia",
-"Australia",
-"Austria",
-"Azerbaijan",
-"Bahamas",
-"Bahrain",
-"Bangladesh",
-"Barbados",
-"Belarus",
-"Belgium",
-"Belize",
-"Benin",
-"Bhutan",
-"Bolivia",
-"Bosnia Herzegovina",
-"Botswana",
-"Brazil",
-"Brunei",
-"Bulgaria",
-"Burkina",
-"Burma",
-"Burundi",
-"Cambodia",
-"Cameroon",
-"Canada",
-"Cape Verde",
-"Central African Rep",
-"Chad",
-"Chile",
-"People's Republic of China",
-"Republic of China, Colombia",
-"Comoros",
-"Democratic Republic of the Congo",
-"Republic of the Congo",
-"Costa Rica,",
-"Croatia",
-"Cuba",
-"Cyprus",
-"Czech Republic",
-"Danzig",
-"Denmark",
-"Djibouti",
-"Dominica",
-"Dominican Republic",
-"East Timor",
-"Ecuador",
-"Egypt",
-"El Salvador",
-"Equatorial Guinea",
-"Eritrea",
-"Estonia",
-"Ethiopia",
-"Fiji",
-"Finland",
-"France",
-"Gabon",
-"Gaza Strip",
-"The Gambia",
-"Georgia",
-"Germany",
-"Ghana, Greece",
-"Grenada",
-"Guatemala",
-"Guinea",
-"Guinea-Bissau",
-"Guyana",
-"Haiti",
-"Holy Roman Empire",
-"Honduras",
-"Hungary",
-"Iceland",
-"India",
-"Indonesia",
-"Iran",
-"Iraq",
-"Republic of Ireland",
-"Israel",
-"Italy",
-"Ivory Coast",
-"Jamaica",
-"Japan",
-"Jonathanland",
-"Jordan",
-"Kazakhstan",
-"Kenya",
-"Kiribati",
-"North Korea",
-"South Korea",
-"Kosovo",
-"Kuwait",
-"Kyrgyzstan",
-"Laos",
-"Latvia",
-"Lebanon",
-"Lesotho",
-"Liberia",
-"Libya",
-"Liechtenstein",
-"Lithuania",
-"Luxembourg",
-"Macedonia",
-"Madagascar",
-"Malawi",
-"Malaysia",
-"Maldives",
-"Mali",
-"Malta",
-"Marshall Islands",
-"Mauritania",
-"Mauritius",
-"Mexico",
-"Micronesia",
-"Moldova",
-"Monaco",
-"Mongolia",
-"Montenegro",
-"Morocco",
-"Mount Athos",
-"Mozambique",
-"Namibia",
-"Nauru",
-"Nepal",
-"Newfoundland",
-"Netherlands",
-"New Zealand",
-"Nicaragua",
-"Niger",
-"Nigeria",
-"Norway",
-"Oman",
-"Ottoman Empire",
-"Pakistan",
-"Palau",
-"Panama",
-"Papua New Guinea, Paraguay",
-"Peru",
-"Philippines",
-"Poland",
-"Portugal",
-"Prussia",
-"Qatar",
-"Romania",
-"Rome",
-"Russian Federation",
-"Rwanda",
-"St Kitts & Nevis",
-"St Lucia",
-"Saint Vincent & the",
-"Grenadines",
-"Samoa",
-"San Marino",
-"Sao Tome & Principe",
-"Saudi Arabia, Senegal",
-"Serbia",
-"Seychelles",
-"Sierra Leone",
-"Singapore",
-"Slovakia",
-"Slovenia",
-"Solomon Islands",
-"Somalia",
-"South Africa, Spain",
-"Sri Lanka",
-"Sudan",
-"Suriname",
-"Swaziland",
-"Sweden",
-"Switzerland",
-"Syria",
-"Tajikistan",
-"Tanzani",
-"Thailand",
-"Togo",
-"Tonga",
-"Trinidad & Tobago",
-"Tunisia",
-"Turkey",
-"Turkmenistan",
-"Tuvalu",
-"Uganda",
-"Ukraine",
-"United Arab Emirates",
-"United Kingdom",
-"United States of America",
-"Uruguay",
-"Uzbekistan",
-"Vanuatu",
-"Vatican City",
-"Venezuela",
-"Vietnam",
-"Yemen",
-"Zambia",
-"Zimbabwe"]
-
-let nationality = [
-  "Afghan",
-"Albanian",
-"Algerian",
-"American",
-"Andorran",
-"Angolan",
-"Antiguans",
-"Argentinean",
-"Armenian",
-"Australian",
-"Austrian",
-"Azerbaijani",
-"Bahamian",
-"Bahraini",
-"Bangladeshi",
-"Barbadian",
-"Barbudans",
-"Batswana",
-"Belarusian",
-"Belgian",
-"Belizean",
-"Beninese",
-"Bhutanese",
-"Bolivian",
-"Bosnian",
-"Brazilian",
-"British",
-"Bruneian",
-"Bulgarian",
-"Burkinabe",
-"Burmese",
-"Burundian",
-"Cambodian",
-"Cameroonian",
-"Canadian",
-"Cape Verdean",
-"Central African",
-"Chadian",
-"Chilean",
-"Chinese",
-"Colombian",
-"Comoran",
-"Congolese",
-"Costa Rican",
-"Croatian",
-"Cuban",
-"Cypriot",
-"Czech",
-"Danish",
-"Djibouti",
-"Dominican",
-"Dutch",
-"East Timorese",
-"Ecuadorean",
-"Egyptian",
-"Emirian",
-"Equatorial Guinean",
-"Eritrean",
-"Estonian",
-"Ethiopian",
-"Fijian",
-"Filipino",
-"Finnish",
-"French",
-"Gabonese",
-"Gambian",
-"Georgian",
-"German",
-"Ghanaian",
-"Greek",
-"Grenadian",
-"Guatemalan",
-"Guinea-Bissauan",
-"Guinean",
-"Guyanese",
-"Haitian",
-"Herzegovinian",
-"Honduran",
-"Hungarian",
-"I-Kiribati",
-"Icelander",
-"Indian",
-"Indonesian",
-"Iranian",
-"Iraqi",
-"Irish",
-"Israeli",
-"Italian",
-"Ivorian",
-"Jamaican",
-"Japanese",
-"Jordanian",
-"Kazakhstani",
-"Kenyan",
-"Kittian and Nevisian",
-"Kuwaiti",
-"Kyrgyz",
-"Laotian",
-"Latvian",
-"Lebanese",
-"Liberian",
-"Libyan",
-"Liechtensteiner",
-"Lithuanian",
-"Luxembourger",
-"Macedonian",
-"Malagasy",
-"Malawian",
-"Malaysian",
-"Maldivian",
-"Malian",
-"Maltese",
-"Marshallese",
-"Mauritanian",
-"Mauritian",
-"Mexican",
-"Micronesian",
-"Moldovan",
-"Monacan",
-"Mongolian",
-"Moroccan",
-"Mosotho",
-"Motswana",
-"Mozambican",
-"Namibian",
-"Nauruan",
-"Nepalese",
-"New Zealander",
-"Ni-Vanuatu",
-"Nicaraguan",
-"Nigerian",
-"Nigerien",
-"North Korean",
-"Northern Irish",
-"Norwegian",
-"Omani",
-"Pakistani",
-"Palauan",
-"Panamanian",
-"Papua New Guinean",
-"Paraguayan",
-"Peruvian",
-"Polish",
-"Portuguese",
-"Qatari",
-"Romanian",
-"Russian",
-"Rwandan",
-"Saint Lucian",
-"Salvadoran",
-"Samoan",
-"San Marinese",
-"Sao Tomean",
-"Saudi",
-"Scottish",
-"Senegalese",
-"Serbian",
-"Seychellois",
-"Sierra Leonean",
-"Singaporean",
-"Slovakian",
-"Slovenian",
-"Solomon Islander",
-"Somali",
-"South African",
-"South Korean",
-"Spanish",
-"Sri Lankan",
-"Sudanese",
-"Surinamer",
-"Swazi",
-"Swedish",
-"Swiss",
-"Syrian",
-"Taiwanese",
-"Tajik",
-"Tanzanian",
-"Thai",
-"Togolese",
-"Tongan",
-"Trinidadian",
-"Tunisian",
-"Turkish",
-"Tuvaluan",
-"Ugandan",
-"Ukrainian",
-"Uruguayan",
-"Uzbekistani",
-"Venezuelan",
-"Vietnamese",
-"Welsh",
-"Yemenite",
-"Zambian",
-"Zimbabwean"
-]
-
-let nationalityID = $('#nationality')
-$.each(nationality, function (index, value) {
-    nationalityID.append($('<option/>', {
-        value: value,
-        text : value
-    }));
-});
-
-let countryID = $('#country')
-$.each(country, function (index, value) {
-    countryID.append($('<option/>', {
-        value: value,
-        text : value
-    }));
-});
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Data access
+//
+// Handlers never touch mgo collections directly; they go through these
+// stores so the app can run against Mongo or entirely in memory.
+var personStore PersonStore
+var adminStore AdminStore
+
+var errNotFound = mgo.ErrNotFound
+
+// Member fields no two members may share. Mongo enforces them with the
+// unique indexes in declaredIndexes, the memory store on insert.
+var PERSON_UNIQUE_FIELDS = []string{"username", "email"}
+
+// duplicateError is returned by a write that would repeat a unique field.
+type duplicateError struct{ Field string }
+
+func (e *duplicateError) Error() string {
+	return e.Field + " is already taken"
+}
+
+// The first admin is stored under ADMIN_FIRST_ID, so that of two first
+// admins registering at once only one insert succeeds.
+var ADMIN_FIRST_ID = "first-admin"
+
+var errFirstAdminTaken = errors.New("the first admin has already registered")
+
+type firstAdmin struct {
+	ID          string `bson:"_id"`
+	AdminPerson `bson:",inline"`
+}
+
+// Fields returned when listing members.
+var PERSON_SUMMARY_FIELDS = []string{"username", "name", "email", "passport", "mobile", "dob", "memberstatus"}
+
+// Fields returned when listing admins.
+var ADMIN_LIST_FIELDS = []string{"name", "username", "role", "totpenabled"}
+
+// Fields of the single document Person records held before the document
+// collection existed.
+var PERSON_LEGACY_DOCUMENT_FIELDS = []string{"documentname", "document", "documentid", "documenttype", "documentsize", "documentsha256"}
+
+type PersonStore interface {
+	Get(username string) (Person, error)
+	// GetByID finds a member by the hex form of their ObjectId.
+	GetByID(id string) (Person, error)
+	GetByEmail(email string) (Person, error)
+	List(filter PersonFilter, fields ...string) ([]Person, error)
+	Insert(person *Person) error
+	UpdateKyc(username string, from KycStatus, decision KycDecision) error
+	UpdateProfile(username string, profile PersonProfile) error
+	UpdatePassword(username string, passwordHash string) error
+	// UpdateEmail changes the member's address, which then needs verifying.
+	UpdateEmail(username string, email string) error
+	// VerifyEmail marks email verified, if it is still the member's address.
+	VerifyEmail(username string, email string) error
+	UpdateMrz(username string, mrz string) error
+	ClearLegacyDocument(username string) error
+	Delete(username string) error
+}
+
+type AdminStore interface {
+	Get(username string) (AdminPerson, error)
+	List() ([]AdminPerson, error)
+	Insert(admin *AdminPerson) error
+	// InsertFirst inserts the first admin, failing with errFirstAdminTaken
+	// if someone else already did.
+	InsertFirst(admin *AdminPerson) error
+	UpdatePassword(username string, passwordHash string) error
+	UpdateRole(username string, role Role) error
+	UpdateTotp(username string, totp AdminTotp) error
+	Delete(username string) error
+}
+
+// PersonFilter selects members by status; empty fields match anything and
+// a member matches Kycstatus if it has any of the listed statuses.
+// Emailverified leaves out members who have not verified their email yet;
+// members from before verification existed count as verified.
+type PersonFilter struct {
+	Memberstatus  MemberStatus
+	Kycstatus     []KycStatus
+	Emailverified bool
+}
+
+func (f PersonFilter) query() bson.M {
+	query := bson.M{}
+	if f.Memberstatus != "" {
+		query["memberstatus"] = f.Memberstatus
+	}
+	if len(f.Kycstatus) > 0 {
+		query["kycstatus"] = bson.M{"$in": f.Kycstatus}
+	}
+	if f.Emailverified {
+		query["emailverified"] = bson.M{"$ne": false}
+	}
+	return query
+}
+
+// KycDecision is the full set of KYC fields written by changeKycStatus.
+type KycDecision struct {
+	Memberstatus MemberStatus
+	Kycstatus    KycStatus
+	Kycreason    string
+	Aml          ScreeningStatus
+	Cft          ScreeningStatus
+	Chequeno     string
+	Bankname     string
+	Amount       Money
+}
+
+// apply sets the decision's fields on person, as update does in the store.
+func (d KycDecision) apply(person *Person) {
+	person.Memberstatus = d.Memberstatus
+	person.Kycstatus = d.Kycstatus
+	person.Kycreason = d.Kycreason
+	person.Aml = d.Aml
+	person.Cft = d.Cft
+	person.Chequeno = d.Chequeno
+	person.Bankname = d.Bankname
+	person.Amount = d.Amount
+}
+
+func (d KycDecision) update() bson.M {
+	return bson.M{
+		"memberstatus": d.Memberstatus,
+		"kycstatus":    d.Kycstatus,
+		"kycreason":    d.Kycreason,
+		"aml":          d.Aml,
+		"cft":          d.Cft,
+		"chequeno":     d.Chequeno,
+		"bankname":     d.Bankname,
+		"amount":       d.Amount}
+}
+
+// PersonProfile holds the member fields an admin may edit.
+type PersonProfile struct {
+	Name        string
+	Gender      Gender
+	Dob         time.Time
+	Nationality string
+	Address1    string
+	Address2    string
+	Country     string
+	Passport    string
+	Mobile      string
+}
+
+// apply sets the profile's fields on person, as update does in the store.
+func (p PersonProfile) apply(person *Person) {
+	person.Name = p.Name
+	person.Gender = p.Gender
+	person.Dob = p.Dob
+	person.Nationality = p.Nationality
+	person.Address1 = p.Address1
+	person.Address2 = p.Address2
+	person.Country = p.Country
+	person.Passport = p.Passport
+	person.Mobile = p.Mobile
+}
+
+func (p PersonProfile) update() bson.M {
+	return bson.M{
+		"name":        p.Name,
+		"gender":      p.Gender,
+		"dob":         p.Dob,
+		"nationality": p.Nationality,
+		"address1":    p.Address1,
+		"address2":    p.Address2,
+		"country":     p.Country,
+		"passport":    p.Passport,
+		"mobile":      p.Mobile}
+}
+
+// AdminTotp is an admin's full two-factor state; the zero value turns it off.
+type AdminTotp struct {
+	Secret        string
+	Enabled       bool
+	Laststep      int64
+	Recoverycodes []string
+}
+
+// apply sets the two-factor fields on admin, as update does in the store.
+func (t AdminTotp) apply(admin *AdminPerson) {
+	admin.Totpsecret = t.Secret
+	admin.Totpenabled = t.Enabled
+	admin.Totplaststep = t.Laststep
+	admin.Recoverycodes = t.Recoverycodes
+}
+
+func (t AdminTotp) update() bson.M {
+	return bson.M{
+		"totpsecret":    t.Secret,
+		"totpenabled":   t.Enabled,
+		"totplaststep":  t.Laststep,
+		"recoverycodes": t.Recoverycodes}
+}
+
+// stampNewPerson gives a member about to be inserted their ID and times.
+func stampNewPerson(person *Person) {
+	if person.ID == "" {
+		person.ID = bson.NewObjectId()
+	}
+	person.Created = time.Now()
+	person.Updated = person.Created
+}
+
+// touched adds the time of a change to the fields it sets.
+func touched(fields bson.M) bson.M {
+	fields["updated"] = time.Now()
+	return fields
+}
+
+func kycQuery(username string, from KycStatus) bson.M {
+	if from == "" {
+		return bson.M{"username": username, "kycstatus": bson.M{"$in": []interface{}{"", nil}}}
+	}
+	return bson.M{"username": username, "kycstatus": from}
+}
+
+func projection(fields []string) bson.M {
+	if len(fields) == 0 {
+		return nil
+	}
+	selector := bson.M{}
+	for _, field := range fields {
+		selector[field] = 1
+	}
+	return selector
+}
+
+// Mongo implementation
+
+type mgoCollection struct {
+	session *mgo.Session
+	name    string
+}
+
+// with runs fn on the collection through a copy of the session, closed
+// again when fn returns.
+func (m mgoCollection) with(fn func(c *mgo.Collection) error) error {
+	session := m.session.Copy()
+	defer session.Close()
+	return fn(session.DB(DB_NAME).C(m.name))
+}
+
+type mgoPersonStore struct{ mgoCollection }
+
+func newMgoPersonStore(session *mgo.Session) *mgoPersonStore {
+	return &mgoPersonStore{mgoCollection{session, DB_COLLECTION_PERSON}}
+}
+
+func (s *mgoPersonStore) Get(username string) (person Person, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"username": username}).One(&person)
+	})
+	return
+}
+
+func (s *mgoPersonStore) GetByID(id string) (person Person, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return person, errNotFound
+	}
+	err = s.with(func(c *mgo.Collection) error {
+		return c.FindId(bson.ObjectIdHex(id)).One(&person)
+	})
+	return
+}
+
+func (s *mgoPersonStore) GetByEmail(email string) (person Person, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"email": email}).One(&person)
+	})
+	return
+}
+
+func (s *mgoPersonStore) List(filter PersonFilter, fields ...string) (persons []Person, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(filter.query()).Select(projection(fields)).All(&persons)
+	})
+	return
+}
+
+func (s *mgoPersonStore) Insert(person *Person) error {
+	stampNewPerson(person)
+	return s.with(func(c *mgo.Collection) error {
+		return duplicateField(c.Insert(person))
+	})
+}
+
+// duplicateField turns a duplicate key error into a duplicateError naming
+// the field, going by the index name in the message.
+func duplicateField(err error) error {
+	if !mgo.IsDup(err) {
+		return err
+	}
+	for _, field := range PERSON_UNIQUE_FIELDS {
+		if strings.Contains(err.Error(), field+"_1 ") {
+			return &duplicateError{field}
+		}
+	}
+	return err
+}
+
+// UpdateKyc only applies if the stored status is still from, so concurrent
+// reviews cannot overwrite each other.
+func (s *mgoPersonStore) UpdateKyc(username string, from KycStatus, decision KycDecision) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(kycQuery(username, from), bson.M{"$set": touched(decision.update())})
+	})
+}
+
+func (s *mgoPersonStore) UpdateProfile(username string, profile PersonProfile) error {
+	return s.set(username, profile.update())
+}
+
+func (s *mgoPersonStore) UpdatePassword(username string, passwordHash string) error {
+	return s.set(username, bson.M{"password": passwordHash})
+}
+
+func (s *mgoPersonStore) UpdateEmail(username string, email string) error {
+	return duplicateField(s.set(username, bson.M{"email": email, "emailverified": false}))
+}
+
+func (s *mgoPersonStore) VerifyEmail(username string, email string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username, "email": email}, bson.M{"$set": touched(bson.M{"emailverified": true})})
+	})
+}
+
+func (s *mgoPersonStore) UpdateMrz(username string, mrz string) error {
+	return s.set(username, bson.M{"mrz": mrz})
+}
+
+func (s *mgoPersonStore) ClearLegacyDocument(username string) error {
+	unset := bson.M{}
+	for _, field := range PERSON_LEGACY_DOCUMENT_FIELDS {
+		unset[field] = ""
+	}
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username}, bson.M{"$unset": unset})
+	})
+}
+
+func (s *mgoPersonStore) Delete(username string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"username": username})
+	})
+}
+
+func (s *mgoPersonStore) set(username string, fields bson.M) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username}, bson.M{"$set": touched(fields)})
+	})
+}
+
+type mgoAdminStore struct{ mgoCollection }
+
+func newMgoAdminStore(session *mgo.Session) *mgoAdminStore {
+	return &mgoAdminStore{mgoCollection{session, DB_COLLECTION_ADMIN_PERSON}}
+}
+
+func (s *mgoAdminStore) Get(username string) (admin AdminPerson, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"username": username}).One(&admin)
+	})
+	return
+}
+
+func (s *mgoAdminStore) List() (admins []AdminPerson, err error) {
+	err = s.with(func(c *mgo.Collection) error {
+		return c.Find(nil).Select(projection(ADMIN_LIST_FIELDS)).All(&admins)
+	})
+	return
+}
+
+func (s *mgoAdminStore) Insert(admin *AdminPerson) error {
+	return s.with(func(c *mgo.Collection) error {
+		return duplicateField(c.Insert(admin))
+	})
+}
+
+func (s *mgoAdminStore) InsertFirst(admin *AdminPerson) error {
+	return s.with(func(c *mgo.Collection) error {
+		err := c.Insert(firstAdmin{ADMIN_FIRST_ID, *admin})
+		if mgo.IsDup(err) {
+			return errFirstAdminTaken
+		}
+		return err
+	})
+}
+
+func (s *mgoAdminStore) UpdatePassword(username string, passwordHash string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username}, bson.M{"$set": bson.M{"password": passwordHash}})
+	})
+}
+
+func (s *mgoAdminStore) UpdateRole(username string, role Role) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username}, bson.M{"$set": bson.M{"role": role}})
+	})
+}
+
+func (s *mgoAdminStore) UpdateTotp(username string, totp AdminTotp) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"username": username}, bson.M{"$set": totp.update()})
+	})
+}
+
+func (s *mgoAdminStore) Delete(username string) error {
+	return s.with(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"username": username})
+	})
+}
+
+// In-memory implementation
+
+type memoryPersonStore struct{ docs *memoryCollection }
+
+func newMemoryPersonStore() *memoryPersonStore {
+	return &memoryPersonStore{newMemoryCollection()}
+}
+
+func (s *memoryPersonStore) Get(username string) (person Person, err error) {
+	err = s.docs.findOne(bson.M{"username": username}, &person)
+	return
+}
+
+func (s *memoryPersonStore) GetByID(id string) (person Person, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return person, errNotFound
+	}
+	err = s.docs.findOne(bson.M{"_id": bson.ObjectIdHex(id)}, &person)
+	return
+}
+
+func (s *memoryPersonStore) GetByEmail(email string) (person Person, err error) {
+	err = s.docs.findOne(bson.M{"email": email}, &person)
+	return
+}
+
+func (s *memoryPersonStore) List(filter PersonFilter, fields ...string) (persons []Person, err error) {
+	err = s.docs.findAll(filter.query(), fields, &persons)
+	return
+}
+
+func (s *memoryPersonStore) Insert(person *Person) error {
+	stampNewPerson(person)
+	return s.docs.insertUnique(person, PERSON_UNIQUE_FIELDS...)
+}
+
+func (s *memoryPersonStore) UpdateKyc(username string, from KycStatus, decision KycDecision) error {
+	return s.docs.update(kycQuery(username, from), touched(decision.update()))
+}
+
+func (s *memoryPersonStore) UpdateProfile(username string, profile PersonProfile) error {
+	return s.docs.update(bson.M{"username": username}, touched(profile.update()))
+}
+
+func (s *memoryPersonStore) UpdatePassword(username string, passwordHash string) error {
+	return s.docs.update(bson.M{"username": username}, touched(bson.M{"password": passwordHash}))
+}
+
+func (s *memoryPersonStore) UpdateEmail(username string, email string) error {
+	return s.docs.update(bson.M{"username": username}, touched(bson.M{"email": email, "emailverified": false}))
+}
+
+func (s *memoryPersonStore) VerifyEmail(username string, email string) error {
+	return s.docs.update(bson.M{"username": username, "email": email}, touched(bson.M{"emailverified": true}))
+}
+
+func (s *memoryPersonStore) UpdateMrz(username string, mrz string) error {
+	return s.docs.update(bson.M{"username": username}, touched(bson.M{"mrz": mrz}))
+}
+
+func (s *memoryPersonStore) ClearLegacyDocument(username string) error {
+	return s.docs.unset(bson.M{"username": username}, PERSON_LEGACY_DOCUMENT_FIELDS...)
+}
+
+func (s *memoryPersonStore) Delete(username string) error {
+	return s.docs.remove(bson.M{"username": username})
+}
+
+type memoryAdminStore struct{ docs *memoryCollection }
+
+func newMemoryAdminStore() *memoryAdminStore {
+	return &memoryAdminStore{newMemoryCollection()}
+}
+
+func (s *memoryAdminStore) Get(username string) (admin AdminPerson, err error) {
+	err = s.docs.findOne(bson.M{"username": username}, &admin)
+	return
+}
+
+func (s *memoryAdminStore) List() (admins []AdminPerson, err error) {
+	err = s.docs.findAll(bson.M{}, ADMIN_LIST_FIELDS, &admins)
+	return
+}
+
+func (s *memoryAdminStore) Insert(admin *AdminPerson) error {
+	return s.docs.insertUnique(admin, "username")
+}
+
+func (s *memoryAdminStore) InsertFirst(admin *AdminPerson) error {
+	err := s.docs.insertUnique(firstAdmin{ADMIN_FIRST_ID, *admin}, "_id", "username")
+	if _, ok := err.(*duplicateError); ok {
+		return errFirstAdminTaken
+	}
+	return err
+}
+
+func (s *memoryAdminStore) UpdatePassword(username string, passwordHash string) error {
+	return s.docs.update(bson.M{"username": username}, bson.M{"password": passwordHash})
+}
+
+func (s *memoryAdminStore) UpdateRole(username string, role Role) error {
+	return s.docs.update(bson.M{"username": username}, bson.M{"role": role})
+}
+
+func (s *memoryAdminStore) UpdateTotp(username string, totp AdminTotp) error {
+	return s.docs.update(bson.M{"username": username}, totp.update())
+}
+
+func (s *memoryAdminStore) Delete(username string) error {
+	return s.docs.remove(bson.M{"username": username})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// Templates
+//
+// Every template in view/ is parsed once, at startup, into a registry. A
+// page is a file in view/ named by its file name ("login.html"); it runs
+// {{template "base" .}} from view/layouts and defines "content" and any
+// other block it changes, and it may use the partials in view/partials.
+// Each page is parsed together with its own copy of the layouts and
+// partials, so pages can define the same blocks. Mail templates are the
+// text templates in view/mail. The server does not start if a page it
+// renders is missing, or if any template does not parse or calls one
+// that is not defined.
+//
+// With TEMPLATE_RELOAD on, the default in dev, view/ is checked every
+// TEMPLATE_POLL_INTERVAL and parsed again when a file changes; if the
+// changed templates do not load, the error is logged and the previous
+// ones stay in use. A build with the view compiled in has nothing to
+// reload.
+var TEMPLATE_RELOAD bool
+var TEMPLATE_POLL_INTERVAL = time.Second
+
+var TEMPLATE_SHARED = []string{"layouts/*.html", "partials/*.html"}
+var TEMPLATE_MAIL = "mail/*.txt"
+
+// The pages handlers render.
+var TEMPLATE_PAGES = []string{
+	"admin_dashboard.html", "admin_login.html", "admin_registration.html", "admin_static_view.html",
+	"admin_totp.html", "admin_view.html", "admins.html", "audit_log.html", "change_password.html",
+	"dashboard.html", "edit_user.html", "error.html", "forgot_password.html", "index.html",
+	"lockouts.html", "login.html", "member_documents.html", "new_members.html", "profile.html",
+	"registration.html", "reset_password.html", "sessions.html", "totp_setup.html",
+}
+
+// The mail templates handlers send.
+var TEMPLATE_MAILS = []string{"password_reset.txt", "verify_email.txt"}
+
+// TEMPLATE_FUNCS are available to every page.
+var TEMPLATE_FUNCS = template.FuncMap{
+	"csrfField":      csrfField,
+	"countryOptions": countryOptions,
+	"date":           dateText,
+	"countryName":    countryName,
+	"adminTotp":      func() bool { return ADMIN_TOTP != ADMIN_TOTP_OFF },
+}
+
+var templatesMu sync.RWMutex
+var pageTemplates map[string]*template.Template
+var mailTemplates *texttemplate.Template
+
+// assetDir is the directory dir within ASSETS.
+func assetDir(dir string) fs.FS {
+	sub, err := fs.Sub(ASSETS, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// loadTemplates parses every template and, if they all load, puts them in
+// the registry.
+func loadTemplates() error {
+	view := assetDir("view")
+	pages, err := parsePages(view)
+	if err != nil {
+		return err
+	}
+	mail, err := texttemplate.ParseFS(view, TEMPLATE_MAIL)
+	if err != nil {
+		return err
+	}
+	for _, name := range TEMPLATE_MAILS {
+		if mail.Lookup(name) == nil {
+			return fmt.Errorf("template: mail/%s is missing", name)
+		}
+	}
+	templatesMu.Lock()
+	pageTemplates, mailTemplates = pages, mail
+	templatesMu.Unlock()
+	return nil
+}
+
+// parsePages parses each page in view with the shared templates and checks
+// it, by escaping a copy, for calls to templates that are not defined.
+func parsePages(view fs.FS) (map[string]*template.Template, error) {
+	shared := template.New("").Funcs(TEMPLATE_FUNCS)
+	for _, pattern := range TEMPLATE_SHARED {
+		if _, err := shared.ParseFS(view, pattern); err != nil {
+			return nil, err
+		}
+	}
+	files, err := fs.Glob(view, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := map[string]*template.Template{}
+	for _, name := range files {
+		page, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := page.ParseFS(view, name); err != nil {
+			return nil, err
+		}
+		check, err := page.Clone()
+		if err != nil {
+			return nil, err
+		}
+		// escaping happens before anything runs and fails on an undefined
+		// template; errors from running it with no data are expected
+		if err := check.ExecuteTemplate(ioutil.Discard, name, nil); err != nil {
+			if escapeErr, ok := err.(*template.Error); ok {
+				return nil, escapeErr
+			}
+		}
+		pages[name] = page
+	}
+	for _, name := range TEMPLATE_PAGES {
+		if pages[name] == nil {
+			return nil, fmt.Errorf("template: %s is missing", name)
+		}
+	}
+	return pages, nil
+}
+
+// executeTemplate runs the page name with data for req. The page also gets
+// req's CSRF token as csrfToken, for {{csrfField $.csrfToken}} in forms.
+func executeTemplate(res http.ResponseWriter, req *http.Request, name string, data map[string]interface{}) (*bytes.Buffer, error) {
+	templatesMu.RLock()
+	page := pageTemplates[name]
+	templatesMu.RUnlock()
+	if page == nil {
+		return nil, fmt.Errorf("template: no page %q", name)
+	}
+	pageData := map[string]interface{}{"csrfToken": csrfToken(res, req)}
+	for key, value := range data {
+		pageData[key] = value
+	}
+	var body bytes.Buffer
+	if err := page.ExecuteTemplate(&body, name, pageData); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// renderTemplate runs a page into a buffer before writing any of it, so a
+// page that fails is answered with an error page rather than half sent. The
+// status is written only then, after the page has set its CSRF cookie.
+func renderTemplate(res http.ResponseWriter, req *http.Request, status int, name string, data map[string]interface{}) error {
+	body, err := executeTemplate(res, req, name, data)
+	if err != nil {
+		return err
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	body.WriteTo(res)
+	return nil
+}
+
+// executeMailTemplate runs the mail template name with data.
+func executeMailTemplate(name string, data interface{}) (string, error) {
+	templatesMu.RLock()
+	mail := mailTemplates
+	templatesMu.RUnlock()
+	if mail == nil {
+		return "", fmt.Errorf("template: no mail %q", name)
+	}
+	var body bytes.Buffer
+	if err := mail.ExecuteTemplate(&body, name, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+// viewVersion changes whenever a file in view/ is added, removed or
+// modified.
+func viewVersion() (string, error) {
+	stamps := []string{}
+	err := fs.WalkDir(assetDir("view"), ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stamps = append(stamps, fmt.Sprintf("%s@%d", path, info.ModTime().UnixNano()))
+		return nil
+	})
+	sort.Strings(stamps)
+	return fmt.Sprint(stamps), err
+}
+
+// watchTemplates reloads the templates whenever view/ changes, for as long
+// as the server runs.
+func watchTemplates() {
+	last, _ := viewVersion()
+	for range time.Tick(TEMPLATE_POLL_INTERVAL) {
+		version, err := viewVersion()
+		if err != nil || version == last {
+			continue
+		}
+		last = version
+		if err := loadTemplates(); err != nil {
+			log.Print("Templates not reloaded: ", err)
+			continue
+		}
+		log.Print("Templates reloaded")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/gorilla/context"
+)
+
+// Two-factor login for admins
+//
+// Admins enrol an RFC 6238 authenticator (SHA-1, 6 digits, 30 second
+// steps) and then need a code from it, or one of their single-use recovery
+// codes, after their password. With ADMIN_TOTP set to required, admins who
+// have not enrolled can only reach the enrolment page. Secrets are stored
+// encrypted with TOTP_KEY (AES-GCM, bound to the username) and recovery
+// codes only as hashes. With ADMIN_TOTP off, the default in dev, there is
+// no TOTP_KEY: admins cannot enrol, and those who did are not asked for
+// codes, since their secrets cannot be read.
+var ADMIN_TOTP_OFF = "off"
+var ADMIN_TOTP_OPTIONAL = "optional"
+var ADMIN_TOTP_REQUIRED = "required"
+
+// Set from the config.
+var ADMIN_TOTP string
+var TOTP_KEY []byte
+var TOTP_ISSUER string
+
+var TOTP_SECRET_LENGTH = 20
+var TOTP_DIGITS = 6
+var TOTP_PERIOD int64 = 30
+
+// Steps either side of now a code is accepted from, for clock drift.
+var TOTP_SKEW int64 = 1
+
+var TOTP_RECOVERY_CODES = 10
+
+// Width and height of the setup page's QR code, in pixels.
+var TOTP_QR_SIZE = 200
+
+// How long the code step may take after the password step.
+var TOTP_PENDING_TIMEOUT = 5 * time.Minute
+
+var TOTP_PENDING_USER = "totp-pending"
+var TOTP_PENDING_SINCE = "totp-since"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errTotpCode = errors.New("That code is not valid.")
+var errTotpOff = statusError(http.StatusNotFound, "Two-factor login is turned off.")
+
+// Codes are checked and marked used under this lock, so one code cannot
+// sign in twice.
+var totpMu sync.Mutex
+
+// totpCode is the RFC 4226 HOTP value of secret at counter step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+// verifyTotp looks for code among the steps around now that come after
+// laststep, and returns the step it matched.
+func verifyTotp(secret []byte, code string, laststep int64, now time.Time) (int64, bool) {
+	current := now.Unix() / TOTP_PERIOD
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= laststep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpQRCode draws uri as a PNG data URL for the setup page, so enrolling
+// needs no script from another site.
+func totpQRCode(uri string) (template.URL, error) {
+	code, err := qr.Encode(uri, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+	if code, err = barcode.Scale(code, TOTP_QR_SIZE, TOTP_QR_SIZE); err != nil {
+		return "", err
+	}
+	var image bytes.Buffer
+	if err := png.Encode(&image, code); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(image.Bytes())), nil
+}
+
+// totpURI is the otpauth:// URI authenticator apps read from the QR code.
+func totpURI(username string, secret []byte) string {
+	label := url.PathEscape(TOTP_ISSUER) + ":" + url.PathEscape(username)
+	query := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {TOTP_ISSUER},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTP_DIGITS)},
+		"period":    {fmt.Sprint(TOTP_PERIOD)}}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func totpGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(TOTP_KEY)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTotpSecret seals secret for username's record.
+func encryptTotpSecret(username string, secret []byte) (string, error) {
+	gcm, err := totpGCM()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, secret, []byte(username))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptTotpSecret(username string, stored string) ([]byte, error) {
+	gcm, err := totpGCM()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("totp: malformed secret")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(username))
+}
+
+// newRecoveryCodes returns codes to show the admin once and the hashes to
+// store.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < TOTP_RECOVERY_CODES; i++ {
+		data := make([]byte, 8)
+		if _, err := rand.Read(data); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(data))[:10]
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecondFactor accepts a current code from admin's authenticator or
+// one of their recovery codes, and marks it used. It reports whether a
+// recovery code was used.
+func checkSecondFactor(admin AdminPerson, code string) (recovery bool, err error) {
+	totpMu.Lock()
+	defer totpMu.Unlock()
+	admin, err = adminStore.Get(admin.Username)
+	if err != nil {
+		return false, err
+	}
+	if !admin.Totpenabled {
+		// reset since the password step
+		return false, errTotpCode
+	}
+	totp := AdminTotp{admin.Totpsecret, admin.Totpenabled, admin.Totplaststep, admin.Recoverycodes}
+	code = strings.TrimSpace(code)
+	if len(code) == TOTP_DIGITS {
+		secret, err := decryptTotpSecret(admin.Username, admin.Totpsecret)
+		if err != nil {
+			return false, err
+		}
+		step, ok := verifyTotp(secret, code, admin.Totplaststep, time.Now())
+		if !ok {
+			return false, errTotpCode
+		}
+		totp.Laststep = step
+		return false, adminStore.UpdateTotp(admin.Username, totp)
+	}
+	hash := hashRecoveryCode(code)
+	for i, stored := range admin.Recoverycodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			totp.Recoverycodes = append(append([]string{}, admin.Recoverycodes[:i]...), admin.Recoverycodes[i+1:]...)
+			return true, adminStore.UpdateTotp(admin.Username, totp)
+		}
+	}
+	return false, errTotpCode
+}
+
+// totpPending returns the admin who passed the password step in session,
+// if they did so recently enough.
+func totpPending(session map[interface{}]interface{}) (string, bool) {
+	username, _ := session[TOTP_PENDING_USER].(string)
+	since, _ := session[TOTP_PENDING_SINCE].(int64)
+	if username == "" || time.Since(time.Unix(since, 0)) > TOTP_PENDING_TIMEOUT {
+		return "", false
+	}
+	return username, true
+}
+
+func adminTotpPageHandler(res http.ResponseWriter, req *http.Request) error {
+	session, _ := STORE.Get(req, ADMIN_SESSION)
+	if _, ok := totpPending(session.Values); !ok {
+		http.Redirect(res, req, loginRetryURL("/admin-login", req.URL.Query().Get("next")), http.StatusSeeOther)
+		return nil
+	}
+	var message interface{}
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message = flashes
+	}
+	session.Save(req, res)
+	return renderTemplate(res, req, http.StatusOK, "admin_totp.html", map[string]interface{}{"message": message, "next": req.URL.Query().Get("next")})
+}
+
+// adminTotpSubmitHandler is the second login step. Wrong codes count as
+// failed logins, so they are throttled like passwords.
+func adminTotpSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	session, _ := STORE.Get(req, ADMIN_SESSION)
+	username, ok := totpPending(session.Values)
+	if !ok {
+		http.Redirect(res, req, loginRetryURL("/admin-login", req.FormValue("next")), http.StatusSeeOther)
+		return nil
+	}
+	retry := "/admin-totp"
+	if next := safeNext(req.FormValue("next"), ""); next != "" {
+		retry += "?next=" + url.QueryEscape(next)
+	}
+	if loginBlocked(req, USER_ADMIN, username) {
+		session.AddFlash(errTotpCode.Error())
+		session.Save(req, res)
+		http.Redirect(res, req, retry, http.StatusSeeOther)
+		return nil
+	}
+	admin, err := adminStore.Get(username)
+	if err == errNotFound {
+		endSession(req, res, session)
+		http.Redirect(res, req, "/admin-login", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recovery, err := checkSecondFactor(admin, req.FormValue("code"))
+	if err == errTotpCode {
+		loginFailed(req, USER_ADMIN, username)
+		session.AddFlash(errTotpCode.Error())
+		session.Save(req, res)
+		http.Redirect(res, req, retry, http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	loginSucceeded(USER_ADMIN, username)
+	if recovery {
+		after, err := adminStore.Get(username)
+		if err != nil {
+			return err
+		}
+		context.Set(req, adminKey, admin)
+		if err := recordAudit(req, AUDIT_TOTP_RECOVERY, username, "", admin, after); err != nil {
+			return err
+		}
+	}
+	startAdminSession(res, req, session, admin)
+	return nil
+}
+
+// totpSetupPageHandler enrols the logged in admin. The secret is kept,
+// unconfirmed, until a code from it is entered, so reloading the page
+// does not invalidate a QR code already scanned.
+func totpSetupPageHandler(res http.ResponseWriter, req *http.Request) error {
+	if ADMIN_TOTP == ADMIN_TOTP_OFF {
+		return errTotpOff
+	}
+	admin := currentAdmin(req)
+	data := map[string]interface{}{"admin": admin, "required": ADMIN_TOTP == ADMIN_TOTP_REQUIRED}
+	if !admin.Totpenabled {
+		secret, err := decryptTotpSecret(admin.Username, admin.Totpsecret)
+		if admin.Totpsecret == "" || err != nil {
+			secret = make([]byte, TOTP_SECRET_LENGTH)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+			sealed, err := encryptTotpSecret(admin.Username, secret)
+			if err == nil {
+				err = adminStore.UpdateTotp(admin.Username, AdminTotp{Secret: sealed})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		data["uri"] = totpURI(admin.Username, secret)
+		data["secret"] = totpEncoding.EncodeToString(secret)
+	}
+	return renderTotpSetupPage(res, req, data)
+}
+
+func totpSetupSubmitHandler(res http.ResponseWriter, req *http.Request) error {
+	if ADMIN_TOTP == ADMIN_TOTP_OFF {
+		return errTotpOff
+	}
+	if err := req.ParseForm(); err != nil {
+		return statusError(http.StatusBadRequest, "The form could not be read.")
+	}
+	admin := currentAdmin(req)
+	if admin.Totpenabled || admin.Totpsecret == "" {
+		http.Redirect(res, req, "/totp-setup", http.StatusSeeOther)
+		return nil
+	}
+	secret, err := decryptTotpSecret(admin.Username, admin.Totpsecret)
+	if err != nil {
+		return err
+	}
+	step, ok := verifyTotp(secret, strings.TrimSpace(req.FormValue("code")), 0, time.Now())
+	if !ok {
+		return renderTotpSetupPage(res, req, map[string]interface{}{
+			"admin":    admin,
+			"required": ADMIN_TOTP == ADMIN_TOTP_REQUIRED,
+			"uri":      totpURI(admin.Username, secret),
+			"secret":   totpEncoding.EncodeToString(secret),
+			"message":  errTotpCode.Error()})
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	totp := AdminTotp{admin.Totpsecret, true, step, hashes}
+	after := admin
+	totp.apply(&after)
+	if err := recordAudit(req, AUDIT_TOTP_ENABLE, admin.Username, "", admin, after); err != nil {
+		return err
+	}
+	if err := adminStore.UpdateTotp(admin.Username, totp); err != nil {
+		return err
+	}
+	return renderTotpSetupPage(res, req, map[string]interface{}{"admin": after, "recoveryCodes": codes})
+}
+
+func renderTotpSetupPage(res http.ResponseWriter, req *http.Request, data map[string]interface{}) error {
+	if uri, ok := data["uri"].(string); ok {
+		image, err := totpQRCode(uri)
+		if err != nil {
+			return err
+		}
+		data["qrcode"], data["qrsize"] = image, TOTP_QR_SIZE
+	}
+	return renderTemplate(res, req, http.StatusOK, "totp_setup.html", data)
+}
+
+// resetTotp turns two-factor login off for username, who has to enrol
+// again, and ends their sessions.
+func resetTotp(username string) error {
+	if err := adminStore.UpdateTotp(username, AdminTotp{}); err != nil {
+		return err
+	}
+	revokeSessions(ADMIN_SESSION, username)
+	return nil
+}
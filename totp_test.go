@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1.
+var totpVectors = []struct {
+	time int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+var totpTestSecret = []byte("12345678901234567890")
+
+func TestTotpCode(t *testing.T) {
+	digits := TOTP_DIGITS
+	defer func() { TOTP_DIGITS = digits }()
+
+	for _, test := range totpVectors {
+		TOTP_DIGITS = 8
+		if got := totpCode(totpTestSecret, test.time/TOTP_PERIOD); got != test.code {
+			t.Errorf("totpCode at %d = %s, want %s", test.time, got, test.code)
+		}
+		TOTP_DIGITS = 6
+		if got, want := totpCode(totpTestSecret, test.time/TOTP_PERIOD), test.code[2:]; got != want {
+			t.Errorf("6 digit totpCode at %d = %s, want %s", test.time, got, want)
+		}
+	}
+}
+
+func TestVerifyTotp(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / TOTP_PERIOD
+	tests := []struct {
+		name     string
+		code     string
+		laststep int64
+		step     int64
+		ok       bool
+	}{
+		{"current step", totpCode(totpTestSecret, step), 0, step, true},
+		{"previous step", totpCode(totpTestSecret, step-1), 0, step - 1, true},
+		{"next step", totpCode(totpTestSecret, step+1), 0, step + 1, true},
+		{"too old", totpCode(totpTestSecret, step-2), 0, 0, false},
+		{"too new", totpCode(totpTestSecret, step+2), 0, 0, false},
+		{"already used", totpCode(totpTestSecret, step), step, 0, false},
+		{"earlier step used", totpCode(totpTestSecret, step), step - 1, step, true},
+		{"wrong code", "000000", 0, 0, false},
+	}
+	for _, test := range tests {
+		matched, ok := verifyTotp(totpTestSecret, test.code, test.laststep, now)
+		if ok != test.ok || matched != test.step {
+			t.Errorf("%s: verifyTotp = %d, %v, want %d, %v", test.name, matched, ok, test.step, test.ok)
+		}
+	}
+}
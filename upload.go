@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Upload validation
+//
+// KYC documents go through readDocumentUpload before they reach the blob
+// store: size limit, content sniffing, extension check, and for images a
+// full decode and re-encode, which drops EXIF and any data smuggled after
+// the image (polyglot files).
+var MAX_UPLOAD_BYTES int64 = 5 << 20
+var MAX_IMAGE_PIXELS = 40 * 1000 * 1000
+var MULTIPART_FORM_OVERHEAD int64 = 1 << 20
+
+var ALLOWED_DOCUMENT_TYPES = map[string][]string{
+	"image/jpeg":      {".jpg", ".jpeg"},
+	"image/png":       {".png"},
+	"application/pdf": {".pdf"},
+}
+
+// Names of active content we refuse in uploaded PDFs. checkPDF matches
+// whole name tokens after decoding #xx escapes, inside object streams too.
+var PDF_BLOCKED_NAMES = map[string]bool{
+	"JavaScript": true, "JS": true, "Launch": true, "EmbeddedFile": true, "EmbeddedFiles": true,
+}
+
+// checkPDF inflates at most this many times MAX_UPLOAD_BYTES from object
+// streams, so a small upload cannot expand without bound.
+var PDF_MAX_INFLATE_RATIO int64 = 4
+
+// Filters other than FlateDecode; object streams using them are refused
+// since their content cannot be checked.
+var PDF_OTHER_FILTERS = map[string]bool{
+	"ASCIIHexDecode": true, "ASCII85Decode": true, "LZWDecode": true, "RunLengthDecode": true,
+	"CCITTFaxDecode": true, "JBIG2Decode": true, "DCTDecode": true, "JPXDecode": true, "Crypt": true,
+}
+
+var errPDFActiveContent = errors.New("PDFs with scripts or attachments are not accepted")
+var errPDFObjectStream = errors.New("the PDF has compressed objects that could not be checked")
+
+// FieldErrors maps form field names to a message shown next to the field.
+type FieldErrors map[string]string
+
+// UploadedDocument is a validated, sanitized upload ready to be stored.
+type UploadedDocument struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// limitUploadBody caps the request body so oversized uploads fail while the
+// form is parsed instead of being buffered to disk.
+func limitUploadBody(res http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(res, req.Body, MAX_UPLOAD_BYTES+MULTIPART_FORM_OVERHEAD)
+}
+
+// parseUploadForm parses a multipart form whose body was limited by
+// limitUploadBody, reporting an oversized body against field.
+func parseUploadForm(req *http.Request, field string, errs FieldErrors) error {
+	err := req.ParseMultipartForm(MAX_UPLOAD_BYTES)
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "request body too large") {
+		errs[field] = fmt.Sprintf("The file must be smaller than %s.", formatBytes(MAX_UPLOAD_BYTES))
+		return nil
+	}
+	return err
+}
+
+// readDocumentUpload validates the file in field, adding a message to errs
+// and returning nil if it is missing or not acceptable.
+func readDocumentUpload(req *http.Request, field string, errs FieldErrors) *UploadedDocument {
+	if _, ok := errs[field]; ok {
+		return nil
+	}
+	file, header, err := req.FormFile(field)
+	if err == http.ErrMissingFile {
+		errs[field] = "Please upload a copy of your ID or passport."
+		return nil
+	}
+	if err != nil {
+		errs[field] = "The uploaded file could not be read."
+		return nil
+	}
+	defer file.Close()
+
+	if header.Size > MAX_UPLOAD_BYTES {
+		errs[field] = fmt.Sprintf("The file must be smaller than %s.", formatBytes(MAX_UPLOAD_BYTES))
+		return nil
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		errs[field] = "The uploaded file could not be read."
+		return nil
+	}
+
+	contentType := http.DetectContentType(data)
+	extensions, ok := ALLOWED_DOCUMENT_TYPES[contentType]
+	if !ok {
+		errs[field] = "Only JPEG, PNG or PDF documents are accepted."
+		return nil
+	}
+	if !hasExtension(header.Filename, extensions) {
+		errs[field] = fmt.Sprintf("The file name must end in %s for this type of file.", strings.Join(extensions, " or "))
+		return nil
+	}
+
+	if contentType == "application/pdf" {
+		err = checkPDF(data)
+	} else {
+		data, err = reencodeImage(data, contentType)
+	}
+	if err != nil {
+		errs[field] = "The document could not be processed: " + err.Error() + "."
+		return nil
+	}
+	return &UploadedDocument{
+		Filename:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		Data:        data}
+}
+
+func hasExtension(filename string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, allowed := range extensions {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// reencodeImage decodes and re-encodes an image so only pixel data survives.
+func reencodeImage(data []byte, contentType string) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("not a valid image")
+	}
+	if config.Width*config.Height > MAX_IMAGE_PIXELS {
+		return nil, errors.New("image dimensions are too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("not a valid image")
+	}
+	var out bytes.Buffer
+	if contentType == "image/png" {
+		err = png.Encode(&out, img)
+	} else {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 92})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func checkPDF(data []byte) error {
+	tail := data
+	if len(tail) > 1024 {
+		tail = tail[len(tail)-1024:]
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || !bytes.Contains(tail, []byte("%%EOF")) {
+		return errors.New("not a valid PDF")
+	}
+	budget := PDF_MAX_INFLATE_RATIO * MAX_UPLOAD_BYTES
+	return scanPDF(data, &budget)
+}
+
+// scanPDF walks the tokens of data, refusing blocked names. Strings and
+// comments are skipped, as are stream contents except for object streams,
+// which hold ordinary objects and are inflated and scanned in turn.
+func scanPDF(data []byte, budget *int64) error {
+	// names seen since the last obj keyword, which for a stream are the
+	// names of its dictionary
+	var dict []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case isPDFSpace(c) || c == '[' || c == ']' || c == '{' || c == '}':
+			i++
+		case c == '%':
+			for i < len(data) && data[i] != '\r' && data[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			i = skipPDFString(data, i)
+		case c == '<' && i+1 < len(data) && data[i+1] == '<', c == '>' && i+1 < len(data) && data[i+1] == '>':
+			i += 2
+		case c == '<':
+			end := bytes.IndexByte(data[i:], '>')
+			if end < 0 {
+				return errors.New("not a valid PDF")
+			}
+			i += end + 1
+		case c == '/':
+			end := i + 1
+			for end < len(data) && !isPDFSpace(data[end]) && !isPDFDelimiter(data[end]) {
+				end++
+			}
+			name := decodePDFName(data[i+1 : end])
+			if PDF_BLOCKED_NAMES[name] {
+				return errPDFActiveContent
+			}
+			dict = append(dict, name)
+			i = end
+		default:
+			end := i + 1
+			for end < len(data) && !isPDFSpace(data[end]) && !isPDFDelimiter(data[end]) {
+				end++
+			}
+			keyword := string(data[i:end])
+			i = end
+			switch keyword {
+			case "obj", "endobj":
+				dict = dict[:0]
+			case "stream":
+				// the data starts after the end of line and runs to endstream
+				if i < len(data) && data[i] == '\r' {
+					i++
+				}
+				if i < len(data) && data[i] == '\n' {
+					i++
+				}
+				end := bytes.Index(data[i:], []byte("endstream"))
+				if end < 0 {
+					return errors.New("not a valid PDF")
+				}
+				if hasPDFName(dict, "ObjStm") {
+					if err := scanObjectStream(data[i:i+end], dict, budget); err != nil {
+						return err
+					}
+				}
+				i += end + len("endstream")
+				dict = dict[:0]
+			}
+		}
+	}
+	return nil
+}
+
+// scanObjectStream inflates an object stream with the dictionary names dict
+// and scans the objects in it.
+func scanObjectStream(data []byte, dict []string, budget *int64) error {
+	for _, name := range dict {
+		if PDF_OTHER_FILTERS[name] || name == "DecodeParms" {
+			return errPDFObjectStream
+		}
+	}
+	// a filter given by reference cannot be told apart from none
+	if hasPDFName(dict, "Filter") && !hasPDFName(dict, "FlateDecode") {
+		return errPDFObjectStream
+	}
+	if hasPDFName(dict, "FlateDecode") {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return errPDFObjectStream
+		}
+		inflated, err := ioutil.ReadAll(io.LimitReader(reader, *budget+1))
+		if err != nil || int64(len(inflated)) > *budget {
+			return errPDFObjectStream
+		}
+		*budget -= int64(len(inflated))
+		data = inflated
+	}
+	return scanPDF(data, budget)
+}
+
+// skipPDFString returns the index just past the literal string at data[i],
+// which may hold balanced parentheses and backslash escapes.
+func skipPDFString(data []byte, i int) int {
+	depth := 0
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// decodePDFName decodes the #xx escapes of a name token without its slash.
+func decodePDFName(raw []byte) string {
+	var name []byte
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) && isHexDigit(raw[i+1]) && isHexDigit(raw[i+2]) {
+			name = append(name, unhex(raw[i+1])<<4|unhex(raw[i+2]))
+			i += 2
+			continue
+		}
+		name = append(name, raw[i])
+	}
+	return string(name)
+}
+
+func hasPDFName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+func formatBytes(n int64) string {
+	if n >= 1<<20 {
+		return fmt.Sprintf("%d MB", n>>20)
+	}
+	return fmt.Sprintf("%d KB", n>>10)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+)
+
+// testPDF wraps objects in a PDF header and trailer.
+func testPDF(objects ...string) []byte {
+	var data bytes.Buffer
+	data.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	for _, object := range objects {
+		data.WriteString(object)
+		data.WriteString("\n")
+	}
+	data.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return data.Bytes()
+}
+
+func deflate(s string) string {
+	var data bytes.Buffer
+	writer := zlib.NewWriter(&data)
+	writer.Write([]byte(s))
+	writer.Close()
+	return data.String()
+}
+
+func objectStream(dict string, content string) string {
+	return "5 0 obj\n<< /Type /ObjStm /N 1 /First 4 " + dict + " >>\nstream\n" + content + "\nendstream\nendobj"
+}
+
+func TestCheckPDF(t *testing.T) {
+	catalog := "1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj"
+	action := "3 0 << /S /JavaScript /JS (app.alert(1)) >>"
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"plain", testPDF(catalog), nil},
+		{"names that start like blocked ones", testPDF(catalog, "2 0 obj\n<< /JSmith 1 /Launcher 2 /Font /JSFont >>\nendobj"), nil},
+		{"blocked names in a string", testPDF(catalog, "2 0 obj\n<< /Title (about /JS and /JavaScript) /Alt <2F4A53> >>\nendobj"), nil},
+		{"blocked names in a comment", testPDF(catalog, "% /JavaScript\n2 0 obj\n<< >>\nendobj"), nil},
+		{"blocked bytes in stream data", testPDF(catalog, "4 0 obj\n<< /Length 16 /Filter /FlateDecode >>\nstream\nxx/JS/Launch xxx\nendstream\nendobj"), nil},
+		{"javascript", testPDF(catalog, "2 0 obj\n<< /OpenAction << /S /JavaScript /JS (app.alert(1)) >> >>\nendobj"), errPDFActiveContent},
+		{"escaped name", testPDF(catalog, "2 0 obj\n<< /OpenAction << /S /J#61vaScript /J#53 (x) >> >>\nendobj"), errPDFActiveContent},
+		{"launch", testPDF(catalog, "2 0 obj\n<</S/Launch/F(calc.exe)>>\nendobj"), errPDFActiveContent},
+		{"attachment", testPDF(catalog, "2 0 obj\n<< /Names << /EmbeddedFiles 6 0 R >> >>\nendobj"), errPDFActiveContent},
+		{"embedded file stream", testPDF(catalog, "6 0 obj\n<< /Type /EmbeddedFile /Length 2 >>\nstream\nhi\nendstream\nendobj"), errPDFActiveContent},
+		{"clean object stream", testPDF(catalog, objectStream("/Filter /FlateDecode", deflate("2 0 << /Type /Pages /Kids [] /Count 0 >>"))), nil},
+		{"uncompressed object stream", testPDF(catalog, objectStream("", action)), errPDFActiveContent},
+		{"object stream", testPDF(catalog, objectStream("/Filter /FlateDecode", deflate(action))), errPDFActiveContent},
+		{"object stream filter array", testPDF(catalog, objectStream("/Filter [/FlateDecode]", deflate(action))), errPDFActiveContent},
+		{"escaped object stream", testPDF(catalog, "5 0 obj\n<< /Type /Obj#53tm /Filter /Fl#61teDecode >>\nstream\n"+deflate(action)+"\nendstream\nendobj"), errPDFActiveContent},
+		{"other filter", testPDF(catalog, objectStream("/Filter /ASCIIHexDecode", "3C3C3E3E>")), errPDFObjectStream},
+		{"filter by reference", testPDF(catalog, objectStream("/Filter 7 0 R", deflate(action))), errPDFObjectStream},
+		{"predictor", testPDF(catalog, objectStream("/Filter /FlateDecode /DecodeParms << /Predictor 12 >>", deflate(action))), errPDFObjectStream},
+		{"corrupt object stream", testPDF(catalog, objectStream("/Filter /FlateDecode", "not deflated")), errPDFObjectStream},
+	}
+	for _, test := range tests {
+		if err := checkPDF(test.data); err != test.err {
+			t.Errorf("%s: checkPDF error = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestCheckPDFInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no header", []byte("hello\n%%EOF\n")},
+		{"no end", []byte("%PDF-1.7\n1 0 obj\n<< >>\nendobj\n")},
+		{"unterminated stream", testPDF("4 0 obj\n<< /Length 9 >>\nstream\nunended")},
+	}
+	for _, test := range tests {
+		if err := checkPDF(test.data); err == nil || err == errPDFActiveContent {
+			t.Errorf("%s: checkPDF error = %v, want not a valid PDF", test.name, err)
+		}
+	}
+}
+
+func TestCheckPDFInflateLimit(t *testing.T) {
+	ratio := PDF_MAX_INFLATE_RATIO
+	PDF_MAX_INFLATE_RATIO = 0
+	defer func() { PDF_MAX_INFLATE_RATIO = ratio }()
+	data := testPDF(objectStream("/Filter /FlateDecode", deflate("2 0 << /Count 0 >>")))
+	if err := checkPDF(data); err != errPDFObjectStream {
+		t.Errorf("checkPDF error = %v, want errPDFObjectStream past the inflate limit", err)
+	}
+}
+
+func TestReencodeImage(t *testing.T) {
+	png := testPNG(t)
+	smuggled := append(append([]byte{}, png...), []byte("<?php system($_GET['c']); ?>")...)
+	data, err := reencodeImage(smuggled, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("<?php")) {
+		t.Error("data after the image survived re-encoding")
+	}
+	if _, err := reencodeImage([]byte("not an image"), "image/png"); err == nil {
+		t.Error("reencodeImage accepted a non-image")
+	}
+}
+
+func TestHasExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		ok       bool
+	}{
+		{"passport.pdf", true},
+		{"PASSPORT.PDF", true},
+		{"passport.pdf.exe", false},
+		{"passport", false},
+	}
+	for _, test := range tests {
+		if got := hasExtension(test.filename, []string{".pdf"}); got != test.ok {
+			t.Errorf("hasExtension(%q) = %v, want %v", test.filename, got, test.ok)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Member details validation
+//
+// Registration, the profile page and the admin edit page read the same
+// fields through readMemberProfile, which also normalizes them: dates of
+// birth are parsed, countries kept as ISO 3166-1 alpha-2 codes and mobile
+// numbers put in E.164 form. Emails are lowercased. Problems are reported
+// per field in errs so the form can be shown again with them.
+var MEMBER_MIN_AGE = 18
+var MEMBER_MAX_AGE = 120
+var DOB_LAYOUT = "2006-01-02"
+
+// the jQuery UI datepicker's default, still sent by cached pages
+var DOB_LAYOUT_US = "01/02/2006"
+
+var USERNAME_PATTERN = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+var PASSPORT_PATTERN = regexp.MustCompile(`^[A-Z0-9]{5,20}$`)
+var MAX_FIELD_LENGTH = 200
+
+// readMemberDetails reads the profile fields and email address from req.
+func readMemberDetails(req *http.Request, errs FieldErrors) (PersonProfile, string) {
+	profile := readMemberProfile(req, errs)
+	email := strings.TrimSpace(req.FormValue("email"))
+	if email == "" {
+		errs["email"] = "This field is required."
+	} else if normalized, problem := normalizeEmail(email); problem != "" {
+		errs["email"] = problem
+	} else {
+		email = normalized
+	}
+	return profile, email
+}
+
+// readMemberProfile reads the profile fields alone, as admins edit them.
+func readMemberProfile(req *http.Request, errs FieldErrors) PersonProfile {
+	profile := PersonProfile{
+		Name:        strings.TrimSpace(req.FormValue("name")),
+		Gender:      Gender(req.FormValue("gender")),
+		Nationality: strings.ToUpper(req.FormValue("nationality")),
+		Address1:    strings.TrimSpace(req.FormValue("address1")),
+		Address2:    strings.TrimSpace(req.FormValue("address2")),
+		Country:     strings.ToUpper(req.FormValue("country")),
+		Passport:    strings.TrimSpace(req.FormValue("passport")),
+		Mobile:      strings.TrimSpace(req.FormValue("mobile"))}
+	dob := strings.TrimSpace(req.FormValue("dob"))
+	required := map[string]string{
+		"name":        profile.Name,
+		"gender":      string(profile.Gender),
+		"dob":         dob,
+		"nationality": profile.Nationality,
+		"address1":    profile.Address1,
+		"country":     profile.Country,
+		"passport":    profile.Passport,
+		"mobile":      profile.Mobile}
+	for field, value := range required {
+		if value == "" {
+			errs[field] = "This field is required."
+		}
+	}
+	check := func(field string, problem string) {
+		if _, ok := errs[field]; !ok && problem != "" {
+			errs[field] = problem
+		}
+	}
+	check("name", checkText(profile.Name))
+	check("address1", checkText(profile.Address1))
+	check("address2", checkText(profile.Address2))
+	if !profile.Gender.valid() {
+		check("gender", "Please choose one.")
+	}
+	var problem string
+	profile.Dob, problem = checkDob(dob, time.Now())
+	check("dob", problem)
+	if _, ok := countryByCode(profile.Nationality); !ok {
+		check("nationality", "Please choose a country from the list.")
+	}
+	if _, ok := countryByCode(profile.Country); !ok {
+		check("country", "Please choose a country from the list.")
+	}
+	profile.Passport, problem = normalizePassport(profile.Passport)
+	check("passport", problem)
+	profile.Mobile, problem = normalizeMobile(profile.Mobile, profile.Country)
+	check("mobile", problem)
+	return profile
+}
+
+// checkText rejects overlong values and control characters.
+func checkText(value string) string {
+	if utf8.RuneCountInString(value) > MAX_FIELD_LENGTH {
+		return "This is too long."
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "This contains characters that are not allowed."
+		}
+	}
+	return ""
+}
+
+// normalizeEmail takes a bare address and lowercases it; addresses are
+// compared that way when checking they are unique.
+func normalizeEmail(value string) (string, string) {
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value || !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+		return value, "Please enter a valid email address."
+	}
+	if len(value) > 254 {
+		return value, "This is too long."
+	}
+	return strings.ToLower(value), ""
+}
+
+func checkUsername(value string) string {
+	if !USERNAME_PATTERN.MatchString(value) {
+		return "Use 3 to 32 letters, digits, dots, dashes or underscores."
+	}
+	return ""
+}
+
+// parseDob reads a date of birth in either layout, as a UTC date.
+func parseDob(value string) (time.Time, error) {
+	dob, err := time.Parse(DOB_LAYOUT, value)
+	if err != nil {
+		dob, err = time.Parse(DOB_LAYOUT_US, value)
+	}
+	return dob, err
+}
+
+// checkDob parses a date of birth and checks the member is old enough on
+// today.
+func checkDob(value string, today time.Time) (time.Time, string) {
+	dob, err := parseDob(value)
+	if err != nil {
+		return time.Time{}, "Please enter a date as YYYY-MM-DD."
+	}
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	if dob.After(today) {
+		return dob, "This date is in the future."
+	}
+	if dob.AddDate(MEMBER_MIN_AGE, 0, 0).After(today) {
+		return dob, "You must be at least " + strconv.Itoa(MEMBER_MIN_AGE) + " years old to be a member."
+	}
+	if !dob.AddDate(MEMBER_MAX_AGE, 0, 0).After(today) {
+		return dob, "Please check the year."
+	}
+	return dob, ""
+}
+
+// normalizePassport drops spaces and dashes and uppercases the rest.
+func normalizePassport(value string) (string, string) {
+	value = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(value))
+	if !PASSPORT_PATTERN.MatchString(value) {
+		return value, "Use 5 to 20 letters and digits."
+	}
+	return value, ""
+}
+
+// normalizeMobile returns value in E.164 form. A number without an
+// international prefix is taken as local to country, losing its trunk 0.
+func normalizeMobile(value string, country string) (string, string) {
+	number := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "", "/", "").Replace(value)
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+	if !strings.HasPrefix(number, "+") {
+		home, ok := countryByCode(country)
+		if !ok {
+			return value, "Please include the country code, like +44."
+		}
+		number = "+" + home.Dial + strings.TrimPrefix(number, "0")
+	}
+	digits := number[1:]
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return value, "Please enter a valid mobile number."
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return value, "Please enter a valid mobile number."
+		}
+	}
+	return number, ""
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeMobile(t *testing.T) {
+	tests := []struct {
+		value   string
+		country string
+		want    string
+		ok      bool
+	}{
+		{"07700 900123", "GB", "+447700900123", true},
+		{"7700-900-123", "gb", "+447700900123", true},
+		{"+44 7700 900123", "", "+447700900123", true},
+		{"0044 7700 900123", "US", "+447700900123", true},
+		{"(415) 555-0100", "US", "+14155550100", true},
+		{"+1 415.555.0100", "GB", "+14155550100", true},
+		{"07700 900123", "", "", false},
+		{"07700 900123", "ZZ", "", false},
+		{"+44 123", "", "", false},
+		{"+1234567890123456", "", "", false},
+		{"+0123456789", "", "", false},
+		{"+44 7700 9OO123", "", "", false},
+	}
+	for _, test := range tests {
+		got, problem := normalizeMobile(test.value, test.country)
+		if (problem == "") != test.ok {
+			t.Errorf("normalizeMobile(%q, %q) problem = %q, want ok %v", test.value, test.country, problem, test.ok)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("normalizeMobile(%q, %q) = %q, want %q", test.value, test.country, got, test.want)
+		}
+	}
+}
+
+func TestCheckDob(t *testing.T) {
+	today := time.Date(2024, 6, 15, 17, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"2000-02-29", time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), true},
+		{"02/29/2000", time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC), true},
+		{"2006-06-15", time.Date(2006, 6, 15, 0, 0, 0, 0, time.UTC), true},
+		{"2006-06-16", time.Time{}, false},
+		{"2024-06-16", time.Time{}, false},
+		{"1904-06-16", time.Date(1904, 6, 16, 0, 0, 0, 0, time.UTC), true},
+		{"1904-06-15", time.Time{}, false},
+		{"2001-02-29", time.Time{}, false},
+		{"29/02/2000", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, test := range tests {
+		dob, problem := checkDob(test.value, today)
+		if (problem == "") != test.ok {
+			t.Errorf("checkDob(%q) problem = %q, want ok %v", test.value, problem, test.ok)
+			continue
+		}
+		if test.ok && !dob.Equal(test.want) {
+			t.Errorf("checkDob(%q) = %v, want %v", test.value, dob, test.want)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"Ann.Smith@Example.com", "ann.smith@example.com", true},
+		{"ann@example", "", false},
+		{"Ann <ann@example.com>", "", false},
+		{" ann@example.com", "", false},
+		{"not an address", "", false},
+	}
+	for _, test := range tests {
+		got, problem := normalizeEmail(test.value)
+		if (problem == "") != test.ok || test.ok && got != test.want {
+			t.Errorf("normalizeEmail(%q) = %q, %q, want %q, ok %v", test.value, got, problem, test.want, test.ok)
+		}
+	}
+}
+
+func TestLowercaseEmails(t *testing.T) {
+	useMemoryStores(t)
+	members := map[string]string{
+		"ann": "Ann.Smith@Example.com",
+		"bob": "bob@example.com",
+		"cy":  "Cy@Example.com",
+		"cy2": "cy@example.com",
+		"dee": "",
+	}
+	for username, email := range members {
+		if err := personStore.Insert(&Person{Username: username, Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changed, err := lowercaseEmails(notLocked, true)
+	if err != nil || changed != 1 {
+		t.Errorf("dry run: %d changed, %v, want 1", changed, err)
+	}
+	if ann, _ := personStore.Get("ann"); ann.Email != "Ann.Smith@Example.com" {
+		t.Errorf("dry run changed ann's email to %q", ann.Email)
+	}
+
+	changed, err = lowercaseEmails(notLocked, false)
+	if err != nil || changed != 1 {
+		t.Errorf("lowercaseEmails: %d changed, %v, want 1", changed, err)
+	}
+	want := map[string]string{
+		"ann": "ann.smith@example.com",
+		"bob": "bob@example.com",
+		"cy":  "Cy@Example.com",
+		"cy2": "cy@example.com",
+		"dee": "",
+	}
+	for username, email := range want {
+		if person, err := personStore.Get(username); err != nil || person.Email != email {
+			t.Errorf("%s: email %q, %v, want %q", username, person.Email, err, email)
+		}
+	}
+	if ann, err := personStore.GetByEmail("ann.smith@example.com"); err != nil || ann.Username != "ann" {
+		t.Errorf("GetByEmail after lowercasing = %q, %v, want ann", ann.Username, err)
+	}
+}